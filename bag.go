@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// bagAlgorithms maps the BagIt names of the supported manifest algorithms
+// to those of the hash engine.
+var bagAlgorithms = map[string]string{
+	"md5":         "md5",
+	"sha1":        "sha1",
+	"sha256":      "sha256",
+	"sha512":      "sha512",
+	"blake2b-512": "blake2b",
+}
+
+// runBag implements the bag subcommand: "bag create" turns a directory into
+// a BagIt bag (RFC 8493) in place and "bag validate" checks one. It returns
+// the exit status: 0 on success or a valid bag, 1 for an invalid bag and 2
+// on error.
+func runBag(args []string) int {
+	if len(args) > 0 {
+		switch args[0] {
+		case "create":
+			return runBagCreate(args[1:])
+		case "validate":
+			return runBagValidate(args[1:])
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Usage: %s bag create|validate [flags] DIR\n", os.Args[0])
+	return 2
+}
+
+// stringList is a flag that may be given several times.
+type stringList []string
+
+func (l *stringList) String() string     { return strings.Join(*l, ", ") }
+func (l *stringList) Set(v string) error { *l = append(*l, v); return nil }
+
+func runBagCreate(args []string) int {
+	fs := flag.NewFlagSet("bag create", flag.ExitOnError)
+	algos := fs.String("hash", "sha512", "comma-separated manifest algorithms: md5, sha1, sha256, sha512, blake2b-512")
+	var info stringList
+	fs.Var(&info, "info", `extra bag-info.txt entry such as "Source-Organization: Example", may be repeated`)
+	progress := fs.Bool("progress", false, "show progress updates")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s bag create [-hash sha512,sha256] [-info \"Label: value\"]... DIR\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	var names []string
+	for _, a := range strings.Split(*algos, ",") {
+		a = strings.ToLower(strings.TrimSpace(a))
+		if _, ok := bagAlgorithms[a]; !ok {
+			log.Printf("-hash: unsupported algorithm %q", a)
+			return 2
+		}
+		names = append(names, a)
+	}
+	for _, e := range info {
+		if label, _, ok := strings.Cut(e, ":"); !ok || strings.TrimSpace(label) == "" {
+			log.Printf("-info: %q is not \"Label: value\"", e)
+			return 2
+		}
+	}
+	err := createBag(signalContext(), fs.Arg(0), names, info, *progress)
+	if err == errInterrupted {
+		return 130
+	}
+	if err != nil {
+		log.Print(err)
+		return 2
+	}
+	return 0
+}
+
+// createBag moves the contents of dir into dir/data and writes the tag
+// files around it: bagit.txt, bag-info.txt and a manifest and tag manifest
+// for every algorithm. The payload is hashed before anything is moved, so
+// an interrupted run leaves dir as it was.
+func createBag(ctx context.Context, dir string, algos, info []string, progress bool) error {
+	if _, err := os.Stat(filepath.Join(dir, "bagit.txt")); err == nil {
+		return fmt.Errorf("%s is already a bag", dir)
+	}
+	paths, infos, err := walkRegular(ctx, dir)
+	if err != nil {
+		return err
+	}
+	var octets int64
+	for _, fi := range infos {
+		octets += fi.Size()
+	}
+	engine := make([]string, len(algos))
+	for i, a := range algos {
+		engine[i] = bagAlgorithms[a]
+	}
+	sums, err := hashAll(ctx, paths, func(p string, read *atomic.Int64) (map[string]string, error) {
+		return hashMultiWithRetry(ctx, p, engine, read)
+	}, progress)
+	if err != nil {
+		return err
+	}
+	if len(sums) < len(paths) {
+		return fmt.Errorf("%d payload files could not be hashed", len(paths)-len(sums))
+	}
+	manifests := map[string]map[string]string{}
+	for _, a := range algos {
+		manifests[a] = map[string]string{}
+	}
+	for p, s := range sums {
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		for _, a := range algos {
+			manifests[a]["data/"+filepath.ToSlash(rel)] = s[bagAlgorithms[a]]
+		}
+	}
+
+	// Move everything through a temporary name in case the payload
+	// itself has a "data" entry.
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, fmt.Sprintf(".bagit-data-%d", os.Getpid()))
+	if err := os.Mkdir(tmp, 0755); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := os.Rename(filepath.Join(dir, e.Name()), filepath.Join(tmp, e.Name())); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, "data")); err != nil {
+		return err
+	}
+
+	var tagFiles []string
+	for _, a := range algos {
+		name := "manifest-" + a + ".txt"
+		if err := writeBagManifest(dir, name, manifests[a]); err != nil {
+			return err
+		}
+		tagFiles = append(tagFiles, name)
+	}
+	if err := writeFileAtomic(filepath.Join(dir, "bagit.txt"), []byte("BagIt-Version: 1.0\nTag-File-Character-Encoding: UTF-8\n")); err != nil {
+		return err
+	}
+	version, _, _ := buildSettings()
+	var b strings.Builder
+	fmt.Fprintf(&b, "Bag-Software-Agent: CheckSumFolder %s\n", version)
+	fmt.Fprintf(&b, "Bagging-Date: %s\n", time.Now().Format(time.DateOnly))
+	fmt.Fprintf(&b, "Payload-Oxum: %d.%d\n", octets, len(paths))
+	for _, e := range info {
+		label, value, _ := strings.Cut(e, ":")
+		fmt.Fprintf(&b, "%s: %s\n", strings.TrimSpace(label), strings.TrimSpace(value))
+	}
+	if err := writeFileAtomic(filepath.Join(dir, "bag-info.txt"), []byte(b.String())); err != nil {
+		return err
+	}
+	tagFiles = append(tagFiles, "bagit.txt", "bag-info.txt")
+
+	tagManifests := map[string]map[string]string{}
+	for _, a := range algos {
+		tagManifests[a] = map[string]string{}
+	}
+	for _, t := range tagFiles {
+		s, err := hashFileMulti(filepath.Join(dir, t), engine, nil)
+		if err != nil {
+			return err
+		}
+		for _, a := range algos {
+			tagManifests[a][t] = s[bagAlgorithms[a]]
+		}
+	}
+	for _, a := range algos {
+		if err := writeBagManifest(dir, "tagmanifest-"+a+".txt", tagManifests[a]); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Created bag %s: %d files, %s, manifests: %s\n", dir, len(paths), formatBytes(octets), strings.Join(algos, ", "))
+	return nil
+}
+
+// writeBagManifest writes sums, keyed by bag-relative path, as the
+// manifest name in the bag at dir.
+func writeBagManifest(dir, name string, sums map[string]string) error {
+	var b strings.Builder
+	for _, rel := range sortedKeys(sums) {
+		fmt.Fprintf(&b, "%s  %s\n", sums[rel], encodeBagPath(rel))
+	}
+	return writeFileAtomic(filepath.Join(dir, name), []byte(b.String()))
+}
+
+// encodeBagPath percent-encodes the characters RFC 8493 requires to be
+// encoded in manifest paths.
+func encodeBagPath(p string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(p)
+}
+
+func decodeBagPath(p string) string {
+	return strings.NewReplacer("%0D", "\r", "%0d", "\r", "%0A", "\n", "%0a", "\n", "%25", "%").Replace(p)
+}
+
+func runBagValidate(args []string) int {
+	fs := flag.NewFlagSet("bag validate", flag.ExitOnError)
+	fast := fs.Bool("fast", false, "only check Payload-Oxum, without hashing")
+	progress := fs.Bool("progress", false, "show progress updates")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s bag validate [-fast] DIR\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	problems, err := validateBag(signalContext(), fs.Arg(0), *fast, *progress)
+	if err == errInterrupted {
+		return 130
+	}
+	if err != nil {
+		log.Print(err)
+		return 2
+	}
+	if problems > 0 {
+		fmt.Printf("Bag %s is invalid: %d problems\n", fs.Arg(0), problems)
+		return 1
+	}
+	fmt.Printf("Bag %s is valid\n", fs.Arg(0))
+	return 0
+}
+
+// bagManifest is a parsed manifest or tag manifest.
+type bagManifest struct {
+	name, algo string
+	entries    map[string]string // bag-relative path to checksum
+}
+
+// validateBag checks the bag at dir and prints every problem found. It
+// returns their number; an error means the bag could not be checked at
+// all.
+func validateBag(ctx context.Context, dir string, fast, progress bool) (int, error) {
+	problems := 0
+	problem := func(format string, a ...any) {
+		problems++
+		fmt.Printf(format+"\n", a...)
+	}
+
+	declaration, err := readBagTags(filepath.Join(dir, "bagit.txt"))
+	if err != nil {
+		return 0, err
+	}
+	if _, ok := declaration["BagIt-Version"]; !ok {
+		problem("bagit.txt: no BagIt-Version")
+	}
+	info, err := readBagTags(filepath.Join(dir, "bag-info.txt"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return 0, err
+	}
+
+	data := filepath.Join(dir, "data")
+	if fi, err := os.Stat(data); err != nil || !fi.IsDir() {
+		problem("data: payload directory missing")
+		return problems, nil
+	}
+	paths, infos, err := walkRegular(ctx, data)
+	if err != nil {
+		return 0, err
+	}
+	if oxum := info["Payload-Oxum"]; len(oxum) > 0 {
+		var octets int64
+		for _, fi := range infos {
+			octets += fi.Size()
+		}
+		if got := fmt.Sprintf("%d.%d", octets, len(paths)); got != oxum[0] {
+			problem("bag-info.txt: Payload-Oxum is %s but the payload is %s", oxum[0], got)
+		}
+	} else if fast {
+		return 0, errors.New("-fast needs a Payload-Oxum in bag-info.txt")
+	}
+	if fast {
+		return problems, nil
+	}
+
+	manifests, err := readBagManifests(dir, "manifest-")
+	if err != nil {
+		return 0, err
+	}
+	if len(manifests) == 0 {
+		problem("no payload manifest")
+	}
+	tagManifests, err := readBagManifests(dir, "tagmanifest-")
+	if err != nil {
+		return 0, err
+	}
+
+	// Every payload file must be in every payload manifest.
+	for _, m := range manifests {
+		for _, p := range paths {
+			rel, _ := filepath.Rel(dir, p)
+			if _, ok := m.entries[filepath.ToSlash(rel)]; !ok {
+				problem("%s NOT_IN_MANIFEST (%s)", rel, m.name)
+			}
+		}
+	}
+	// Every file is read once for all the algorithms of the manifests.
+	all := slices.Concat(manifests, tagManifests)
+	files := make([][]string, len(all))
+	var listed, algos []string
+	for i, m := range all {
+		if a := bagAlgorithms[m.algo]; !slices.Contains(algos, a) {
+			algos = append(algos, a)
+		}
+		for rel := range m.entries {
+			if strings.HasPrefix(m.name, "manifest-") && !strings.HasPrefix(rel, "data/") {
+				problem("%s: %s is outside the payload", m.name, rel)
+				continue
+			}
+			files[i] = append(files[i], filepath.Join(dir, filepath.FromSlash(rel)))
+		}
+		slices.Sort(files[i])
+		listed = append(listed, files[i]...)
+	}
+	slices.Sort(listed)
+	listed = slices.Compact(listed)
+	sums, err := hashAll(ctx, listed, func(p string, read *atomic.Int64) (map[string]string, error) {
+		return hashMultiWithRetry(ctx, p, algos, read)
+	}, progress)
+	if err != nil {
+		return 0, err
+	}
+	for i, m := range all {
+		for _, p := range files[i] {
+			rel, _ := filepath.Rel(dir, p)
+			rel = filepath.ToSlash(rel)
+			sum, ok := sums[p]
+			switch {
+			case !ok:
+				if _, err := os.Stat(p); errors.Is(err, os.ErrNotExist) {
+					problem("%s MISSING (%s)", rel, m.name)
+				} else {
+					problem("%s UNREADABLE (%s)", rel, m.name)
+				}
+			case !strings.EqualFold(sum[bagAlgorithms[m.algo]], m.entries[rel]):
+				problem("%s MISMATCH (%s)", rel, m.name)
+			}
+		}
+	}
+	return problems, nil
+}
+
+// readBagManifests reads the manifests in dir whose names start with
+// prefix, such as "manifest-" or "tagmanifest-".
+func readBagManifests(dir, prefix string) ([]bagManifest, error) {
+	names, err := filepath.Glob(filepath.Join(dir, prefix+"*.txt"))
+	if err != nil {
+		return nil, err
+	}
+	var ms []bagManifest
+	for _, n := range names {
+		name := filepath.Base(n)
+		algo := strings.TrimSuffix(strings.TrimPrefix(name, prefix), ".txt")
+		if _, ok := bagAlgorithms[algo]; !ok {
+			return nil, fmt.Errorf("%s: unsupported algorithm %q", name, algo)
+		}
+		m := bagManifest{name: name, algo: algo, entries: map[string]string{}}
+		f, err := os.Open(n)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		for line := 1; scanner.Scan(); line++ {
+			text := strings.TrimRight(scanner.Text(), "\r")
+			if strings.TrimSpace(text) == "" {
+				continue
+			}
+			i := strings.IndexAny(text, " \t")
+			var sum, rel string
+			if i >= 0 {
+				sum, rel = text[:i], decodeBagPath(strings.TrimLeft(text[i+1:], " \t"))
+			}
+			if rel == "" || path.IsAbs(rel) || slices.Contains(strings.Split(rel, "/"), "..") {
+				f.Close()
+				return nil, fmt.Errorf("%s:%d: malformed manifest line", name, line)
+			}
+			m.entries[path.Clean(rel)] = sum
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, m)
+	}
+	return ms, nil
+}
+
+// readBagTags parses a tag file of "Label: value" lines, where lines
+// starting with whitespace continue the previous value.
+func readBagTags(path string) (map[string][]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	tags := map[string][]string{}
+	var last string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && last != "" {
+			vs := tags[last]
+			vs[len(vs)-1] += " " + strings.TrimSpace(line)
+			continue
+		}
+		label, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("%s: malformed line %s", filepath.Base(path), strconv.Quote(line))
+		}
+		last = strings.TrimSpace(label)
+		tags[last] = append(tags[last], strings.TrimSpace(value))
+	}
+	return tags, scanner.Err()
+}
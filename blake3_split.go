@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"CheckSumFolder/blake3c"
+)
+
+// splitThreshold is the file size from which BLAKE3 hashes a single file on
+// several cores. Zero disables splitting. Set from -split-mb.
+var splitThreshold int64 = 128 << 20
+
+// splitSegment is the size of the subtrees hashed concurrently. It must be
+// a power-of-two number of BLAKE3 chunks.
+const splitSegment = 4 << 20
+
+// splitTokens bounds the segments in flight across all files so that
+// several large files hashed at once do not multiply the buffer memory.
+var splitTokens = make(chan struct{}, runtime.NumCPU())
+
+var splitBufs = sync.Pool{New: func() any {
+	b := make([]byte, splitSegment)
+	return &b
+}}
+
+// newBlake3C returns a C BLAKE3 hasher, keyed when -key is set.
+func newBlake3C() *blake3c.Hasher {
+	if hashKey != nil {
+		var k [32]byte
+		copy(k[:], hashKey)
+		return blake3c.BLAKE3InitKeyed(&k)
+	}
+	return blake3c.BLAKE3Init()
+}
+
+// hashBlake3Split hashes f with the C BLAKE3 implementation, computing the
+// subtrees of every full segment concurrently. The result is the standard
+// BLAKE3 digest of the whole file. Bytes read are added to read if it is
+// not nil.
+func hashBlake3Split(f *os.File, size int64, read *atomic.Int64) ([]byte, error) {
+	h := newBlake3C()
+
+	// Always leave at least one byte for the ordinary update path so the
+	// root node is finalized by the library itself.
+	segs := (size - 1) / splitSegment
+	cvs := make([][64]byte, segs)
+
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var readErr error
+	for i := int64(0); i < segs; i++ {
+		splitTokens <- struct{}{}
+		wg.Add(1)
+		go func(i int64) {
+			defer func() {
+				<-splitTokens
+				wg.Done()
+			}()
+			buf := splitBufs.Get().(*[]byte)
+			off := i * splitSegment
+			var err error
+			if readTimeout > 0 {
+				_, err = withTimeout(func() (int, error) { return f.ReadAt(*buf, off) })
+			} else {
+				_, err = f.ReadAt(*buf, off)
+			}
+			if err != nil {
+				errOnce.Do(func() { readErr = err })
+				// A timed-out read may still fill buf later.
+				if err != errReadTimeout {
+					splitBufs.Put(buf)
+				}
+				return
+			}
+			defer splitBufs.Put(buf)
+			if read != nil {
+				read.Add(splitSegment)
+			}
+			cvs[i] = h.SubtreeCVs(*buf, uint64(i*splitSegment/blake3c.ChunkLen))
+		}(i)
+	}
+	wg.Wait()
+	if readErr != nil {
+		return nil, readErr
+	}
+
+	for i := range cvs {
+		h.PushSubtree(&cvs[i], splitSegment/blake3c.ChunkLen)
+	}
+	tail := io.NewSectionReader(f, segs*splitSegment, size-segs*splitSegment)
+	r := newTimeoutReader(tail)
+	if read != nil {
+		r = countingReader{r, read}
+	}
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"CheckSumFolder/blake3c"
+	"github.com/zeebo/blake3"
+)
+
+func TestHashBlake3Split(t *testing.T) {
+	if blake3c.Backend != "c" {
+		t.Skip("splitting needs the C BLAKE3 implementation")
+	}
+	const seg = splitSegment
+	sizes := []int64{0, 1, blake3c.ChunkLen, seg - 1, seg, seg + 1, 2*seg - 1, 2 * seg, 2*seg + 1, 3 * seg, 3*seg + 1, 3*seg + 12345}
+	data := make([]byte, sizes[len(sizes)-1])
+	rand.New(rand.NewSource(1)).Read(data)
+	key := bytes.Repeat([]byte{0x42}, 32)
+
+	defer func(k []byte) { hashKey = k }(hashKey)
+	for _, keyed := range []bool{false, true} {
+		hashKey = nil
+		if keyed {
+			hashKey = key
+		}
+		for _, size := range sizes {
+			t.Run(fmt.Sprintf("keyed=%v/size=%d", keyed, size), func(t *testing.T) {
+				p := filepath.Join(t.TempDir(), "f")
+				if err := os.WriteFile(p, data[:size], 0o644); err != nil {
+					t.Fatal(err)
+				}
+				f, err := os.Open(p)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer f.Close()
+				got, err := hashBlake3Split(f, size, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				want := blake3.New()
+				if keyed {
+					want, _ = blake3.NewKeyed(key)
+				}
+				want.Write(data[:size])
+				if !bytes.Equal(got, want.Sum(nil)) {
+					t.Errorf("got %x, want %x", got, want.Sum(nil))
+				}
+			})
+		}
+	}
+}
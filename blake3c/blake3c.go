@@ -5,7 +5,7 @@ package blake3c
 /*
 #cgo CFLAGS: -O3 -std=c99
 #cgo !windows CFLAGS: -fno-stack-protector -fPIC
-#cgo amd64 CFLAGS: -DBLAKE3_NO_SSE2 -DBLAKE3_NO_SSE41 -DBLAKE3_NO_AVX2 -DBLAKE3_NO_AVX512
+#cgo amd64 CFLAGS: -DBLAKE3_NO_SSE2
 #cgo arm64 CFLAGS: -DBLAKE3_USE_NEON
 #include "blake3.h"
 #include "blake3_impl.h"
@@ -15,10 +15,40 @@ package blake3c
 #if BLAKE3_USE_NEON
 #include "lib/blake3_neon.c"
 #endif
+#if defined(IS_X86_64)
+#include "lib/blake3_sse41.c"
+#include "lib/blake3_avx2.c"
+#include "lib/blake3_avx512.c"
+#endif
+
+// Subtree helpers for hashing separate parts of one input concurrently.
+// len must be a power-of-two number of chunks, at least two.
+static void blake3_subtree_cvs(const blake3_hasher *h, const void *input,
+                               size_t len, uint64_t chunk_counter,
+                               uint8_t out[2 * BLAKE3_OUT_LEN]) {
+  compress_subtree_to_parent_node((const uint8_t *)input, len, h->key,
+                                  chunk_counter, h->chunk.flags, out, false);
+}
+
+// The hasher must hold no partial chunk, and subtrees must be pushed in
+// input order, exactly like blake3_hasher_update_base does.
+static void blake3_hasher_push_subtree(blake3_hasher *h,
+                                       uint8_t cvs[2 * BLAKE3_OUT_LEN],
+                                       uint64_t chunks) {
+  hasher_push_cv(h, cvs, h->chunk.chunk_counter);
+  hasher_push_cv(h, &cvs[BLAKE3_OUT_LEN], h->chunk.chunk_counter + chunks / 2);
+  h->chunk.chunk_counter += chunks;
+}
 */
 import "C"
 import "unsafe"
 
+// Backend names the implementation compiled into this build.
+const Backend = "c"
+
+// ChunkLen is the BLAKE3 chunk size; subtrees are measured in chunks.
+const ChunkLen = 1024
+
 type Hasher struct{ h C.blake3_hasher }
 
 // BLAKE3Init initializes a new hashing state.
@@ -28,6 +58,13 @@ func BLAKE3Init() *Hasher {
 	return h
 }
 
+// BLAKE3InitKeyed initializes a hashing state in keyed mode.
+func BLAKE3InitKeyed(key *[32]byte) *Hasher {
+	h := new(Hasher)
+	C.blake3_hasher_init_keyed(&h.h, (*C.uint8_t)(unsafe.Pointer(&key[0])))
+	return h
+}
+
 // BLAKE3Update adds more data to the hash state.
 func BLAKE3Update(h *Hasher, b []byte) {
 	if len(b) == 0 {
@@ -56,3 +93,19 @@ func (h *Hasher) Sum(b []byte) []byte {
 
 func (h *Hasher) Size() int      { return 32 }
 func (h *Hasher) BlockSize() int { return 64 }
+
+// SubtreeCVs returns the two child chaining values of the complete subtree
+// formed by data, which starts at chunk index chunk. len(data) must be a
+// power-of-two multiple of ChunkLen, at least two chunks. It only reads h
+// and is safe to call concurrently.
+func (h *Hasher) SubtreeCVs(data []byte, chunk uint64) [64]byte {
+	var out [64]byte
+	C.blake3_subtree_cvs(&h.h, unsafe.Pointer(&data[0]), C.size_t(len(data)), C.uint64_t(chunk), (*C.uint8_t)(unsafe.Pointer(&out[0])))
+	return out
+}
+
+// PushSubtree appends a subtree computed by SubtreeCVs that spans chunks
+// chunks. Subtrees must be pushed in order, before any Write.
+func (h *Hasher) PushSubtree(cvs *[64]byte, chunks uint64) {
+	C.blake3_hasher_push_subtree(&h.h, (*C.uint8_t)(unsafe.Pointer(&cvs[0])), C.uint64_t(chunks))
+}
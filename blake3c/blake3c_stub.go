@@ -4,6 +4,12 @@ package blake3c
 
 import "github.com/zeebo/blake3"
 
+// Backend names the implementation compiled into this build.
+const Backend = "go"
+
+// ChunkLen is the BLAKE3 chunk size; subtrees are measured in chunks.
+const ChunkLen = 1024
+
 // Hasher wraps the pure-Go blake3 Hasher to match the cgo implementation API.
 type Hasher struct{ h *blake3.Hasher }
 
@@ -11,6 +17,11 @@ func BLAKE3Init() *Hasher {
 	return &Hasher{h: blake3.New()}
 }
 
+func BLAKE3InitKeyed(key *[32]byte) *Hasher {
+	h, _ := blake3.NewKeyed(key[:])
+	return &Hasher{h: h}
+}
+
 func BLAKE3Update(h *Hasher, b []byte) {
 	if len(b) == 0 {
 		return
@@ -29,3 +40,13 @@ func (h *Hasher) Write(p []byte) (int, error) { return h.h.Write(p) }
 func (h *Hasher) Sum(b []byte) []byte         { return h.h.Sum(b) }
 func (h *Hasher) Size() int                   { return 32 }
 func (h *Hasher) BlockSize() int              { return 64 }
+
+// SubtreeCVs needs the C implementation; callers must check Backend first.
+func (h *Hasher) SubtreeCVs(data []byte, chunk uint64) [64]byte {
+	panic("blake3c: subtree hashing requires the C implementation")
+}
+
+// PushSubtree needs the C implementation; callers must check Backend first.
+func (h *Hasher) PushSubtree(cvs *[64]byte, chunks uint64) {
+	panic("blake3c: subtree hashing requires the C implementation")
+}
@@ -0,0 +1,49 @@
+package blake3c
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/zeebo/blake3"
+)
+
+// Vectors from the official BLAKE3 test_vectors.json: the input is n bytes
+// of the repeating pattern 0, 1, ..., 250.
+var knownAnswers = []struct {
+	n   int
+	sum string
+}{
+	{0, "af1349b9f5f9a1a6a0404dea36dcc9499bcb25c9adc112b7cc9a93cae41f3262"},
+	{1, "2d3adedff11b61f14c886e35afa036736dcd87a74d27b5c1510225d0f592e213"},
+	{1023, "10108970eeda3eb932baac1428c7a2163b0e924c9a9e25b35bba72b28f70bd11"},
+	{1024, "42214739f095a406f3fc83deb889744ac00df831c10daa55189b5d121c855af7"},
+	{1025, "d00278ae47eb27b34faecf67b4fe263f82d5412916c1ffd97c8cb7fb814b8444"},
+	{2048, "e776b6028c7cd22a4d0ba182a8bf62205d2ef576467e838ed6f2529b85fba24a"},
+	{31744, "62b6960e1a44bcc1eb1a611a8d6235b6b4b78f32e7abc4fb4c6cdcce94895c47"},
+	{102400, "bc3e3d41a1146b069abffad3c0d44860cf664390afce4d9661f7902e7943e085"},
+}
+
+func pattern(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i % 251)
+	}
+	return b
+}
+
+// TestKnownAnswers checks that the compiled backend and the pure Go
+// package, which -impl blake3=go selects, both give the reference digests.
+func TestKnownAnswers(t *testing.T) {
+	for _, tc := range knownAnswers {
+		data := pattern(tc.n)
+		h := BLAKE3Init()
+		h.Write(data)
+		if got := hex.EncodeToString(h.Sum(nil)); got != tc.sum {
+			t.Errorf("%s backend, %d bytes: got %s, want %s", Backend, tc.n, got, tc.sum)
+		}
+		sum := blake3.Sum256(data)
+		if got := hex.EncodeToString(sum[:]); got != tc.sum {
+			t.Errorf("go, %d bytes: got %s, want %s", tc.n, got, tc.sum)
+		}
+	}
+}
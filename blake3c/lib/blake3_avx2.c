@@ -0,0 +1,326 @@
+//go:build amd64
+
+#include "blake3_impl.h"
+
+#include <immintrin.h>
+
+// Compiled for AVX2 only; see the note in blake3_sse41.c.
+#if defined(__clang__)
+#pragma clang attribute push(__attribute__((target("avx2"))), apply_to = function)
+#elif defined(__GNUC__)
+#pragma GCC push_options
+#pragma GCC target("avx2")
+#endif
+
+#define DEGREE_AVX2 8
+
+INLINE __m256i loadu_avx2(const uint8_t src[32]) {
+  return _mm256_loadu_si256((const __m256i *)src);
+}
+
+INLINE void storeu_avx2(__m256i src, uint8_t dest[32]) {
+  _mm256_storeu_si256((__m256i *)dest, src);
+}
+
+INLINE __m256i add_avx2(__m256i a, __m256i b) { return _mm256_add_epi32(a, b); }
+
+INLINE __m256i xor_avx2(__m256i a, __m256i b) {
+  return _mm256_xor_si256(a, b);
+}
+
+INLINE __m256i set1_avx2(uint32_t x) { return _mm256_set1_epi32((int32_t)x); }
+
+INLINE __m256i rot16_avx2(__m256i x) {
+  return _mm256_shuffle_epi8(
+      x, _mm256_set_epi8(13, 12, 15, 14, 9, 8, 11, 10, 5, 4, 7, 6, 1, 0, 3, 2,
+                         13, 12, 15, 14, 9, 8, 11, 10, 5, 4, 7, 6, 1, 0, 3, 2));
+}
+
+INLINE __m256i rot12_avx2(__m256i x) {
+  return _mm256_or_si256(_mm256_srli_epi32(x, 12), _mm256_slli_epi32(x, 32 - 12));
+}
+
+INLINE __m256i rot8_avx2(__m256i x) {
+  return _mm256_shuffle_epi8(
+      x, _mm256_set_epi8(12, 15, 14, 13, 8, 11, 10, 9, 4, 7, 6, 5, 0, 3, 2, 1,
+                         12, 15, 14, 13, 8, 11, 10, 9, 4, 7, 6, 5, 0, 3, 2, 1));
+}
+
+INLINE __m256i rot7_avx2(__m256i x) {
+  return _mm256_or_si256(_mm256_srli_epi32(x, 7), _mm256_slli_epi32(x, 32 - 7));
+}
+
+/*
+ * ----------------------------------------------------------------------------
+ * hash8_avx2
+ * ----------------------------------------------------------------------------
+ */
+
+INLINE void round_fn8_avx2(__m256i v[16], __m256i m[16], size_t r) {
+  v[0] = add_avx2(v[0], m[(size_t)MSG_SCHEDULE[r][0]]);
+  v[1] = add_avx2(v[1], m[(size_t)MSG_SCHEDULE[r][2]]);
+  v[2] = add_avx2(v[2], m[(size_t)MSG_SCHEDULE[r][4]]);
+  v[3] = add_avx2(v[3], m[(size_t)MSG_SCHEDULE[r][6]]);
+  v[0] = add_avx2(v[0], v[4]);
+  v[1] = add_avx2(v[1], v[5]);
+  v[2] = add_avx2(v[2], v[6]);
+  v[3] = add_avx2(v[3], v[7]);
+  v[12] = xor_avx2(v[12], v[0]);
+  v[13] = xor_avx2(v[13], v[1]);
+  v[14] = xor_avx2(v[14], v[2]);
+  v[15] = xor_avx2(v[15], v[3]);
+  v[12] = rot16_avx2(v[12]);
+  v[13] = rot16_avx2(v[13]);
+  v[14] = rot16_avx2(v[14]);
+  v[15] = rot16_avx2(v[15]);
+  v[8] = add_avx2(v[8], v[12]);
+  v[9] = add_avx2(v[9], v[13]);
+  v[10] = add_avx2(v[10], v[14]);
+  v[11] = add_avx2(v[11], v[15]);
+  v[4] = xor_avx2(v[4], v[8]);
+  v[5] = xor_avx2(v[5], v[9]);
+  v[6] = xor_avx2(v[6], v[10]);
+  v[7] = xor_avx2(v[7], v[11]);
+  v[4] = rot12_avx2(v[4]);
+  v[5] = rot12_avx2(v[5]);
+  v[6] = rot12_avx2(v[6]);
+  v[7] = rot12_avx2(v[7]);
+  v[0] = add_avx2(v[0], m[(size_t)MSG_SCHEDULE[r][1]]);
+  v[1] = add_avx2(v[1], m[(size_t)MSG_SCHEDULE[r][3]]);
+  v[2] = add_avx2(v[2], m[(size_t)MSG_SCHEDULE[r][5]]);
+  v[3] = add_avx2(v[3], m[(size_t)MSG_SCHEDULE[r][7]]);
+  v[0] = add_avx2(v[0], v[4]);
+  v[1] = add_avx2(v[1], v[5]);
+  v[2] = add_avx2(v[2], v[6]);
+  v[3] = add_avx2(v[3], v[7]);
+  v[12] = xor_avx2(v[12], v[0]);
+  v[13] = xor_avx2(v[13], v[1]);
+  v[14] = xor_avx2(v[14], v[2]);
+  v[15] = xor_avx2(v[15], v[3]);
+  v[12] = rot8_avx2(v[12]);
+  v[13] = rot8_avx2(v[13]);
+  v[14] = rot8_avx2(v[14]);
+  v[15] = rot8_avx2(v[15]);
+  v[8] = add_avx2(v[8], v[12]);
+  v[9] = add_avx2(v[9], v[13]);
+  v[10] = add_avx2(v[10], v[14]);
+  v[11] = add_avx2(v[11], v[15]);
+  v[4] = xor_avx2(v[4], v[8]);
+  v[5] = xor_avx2(v[5], v[9]);
+  v[6] = xor_avx2(v[6], v[10]);
+  v[7] = xor_avx2(v[7], v[11]);
+  v[4] = rot7_avx2(v[4]);
+  v[5] = rot7_avx2(v[5]);
+  v[6] = rot7_avx2(v[6]);
+  v[7] = rot7_avx2(v[7]);
+
+  v[0] = add_avx2(v[0], m[(size_t)MSG_SCHEDULE[r][8]]);
+  v[1] = add_avx2(v[1], m[(size_t)MSG_SCHEDULE[r][10]]);
+  v[2] = add_avx2(v[2], m[(size_t)MSG_SCHEDULE[r][12]]);
+  v[3] = add_avx2(v[3], m[(size_t)MSG_SCHEDULE[r][14]]);
+  v[0] = add_avx2(v[0], v[5]);
+  v[1] = add_avx2(v[1], v[6]);
+  v[2] = add_avx2(v[2], v[7]);
+  v[3] = add_avx2(v[3], v[4]);
+  v[15] = xor_avx2(v[15], v[0]);
+  v[12] = xor_avx2(v[12], v[1]);
+  v[13] = xor_avx2(v[13], v[2]);
+  v[14] = xor_avx2(v[14], v[3]);
+  v[15] = rot16_avx2(v[15]);
+  v[12] = rot16_avx2(v[12]);
+  v[13] = rot16_avx2(v[13]);
+  v[14] = rot16_avx2(v[14]);
+  v[10] = add_avx2(v[10], v[15]);
+  v[11] = add_avx2(v[11], v[12]);
+  v[8] = add_avx2(v[8], v[13]);
+  v[9] = add_avx2(v[9], v[14]);
+  v[5] = xor_avx2(v[5], v[10]);
+  v[6] = xor_avx2(v[6], v[11]);
+  v[7] = xor_avx2(v[7], v[8]);
+  v[4] = xor_avx2(v[4], v[9]);
+  v[5] = rot12_avx2(v[5]);
+  v[6] = rot12_avx2(v[6]);
+  v[7] = rot12_avx2(v[7]);
+  v[4] = rot12_avx2(v[4]);
+  v[0] = add_avx2(v[0], m[(size_t)MSG_SCHEDULE[r][9]]);
+  v[1] = add_avx2(v[1], m[(size_t)MSG_SCHEDULE[r][11]]);
+  v[2] = add_avx2(v[2], m[(size_t)MSG_SCHEDULE[r][13]]);
+  v[3] = add_avx2(v[3], m[(size_t)MSG_SCHEDULE[r][15]]);
+  v[0] = add_avx2(v[0], v[5]);
+  v[1] = add_avx2(v[1], v[6]);
+  v[2] = add_avx2(v[2], v[7]);
+  v[3] = add_avx2(v[3], v[4]);
+  v[15] = xor_avx2(v[15], v[0]);
+  v[12] = xor_avx2(v[12], v[1]);
+  v[13] = xor_avx2(v[13], v[2]);
+  v[14] = xor_avx2(v[14], v[3]);
+  v[15] = rot8_avx2(v[15]);
+  v[12] = rot8_avx2(v[12]);
+  v[13] = rot8_avx2(v[13]);
+  v[14] = rot8_avx2(v[14]);
+  v[10] = add_avx2(v[10], v[15]);
+  v[11] = add_avx2(v[11], v[12]);
+  v[8] = add_avx2(v[8], v[13]);
+  v[9] = add_avx2(v[9], v[14]);
+  v[5] = xor_avx2(v[5], v[10]);
+  v[6] = xor_avx2(v[6], v[11]);
+  v[7] = xor_avx2(v[7], v[8]);
+  v[4] = xor_avx2(v[4], v[9]);
+  v[5] = rot7_avx2(v[5]);
+  v[6] = rot7_avx2(v[6]);
+  v[7] = rot7_avx2(v[7]);
+  v[4] = rot7_avx2(v[4]);
+}
+
+INLINE void transpose_vecs_avx2(__m256i vecs[DEGREE_AVX2]) {
+  // Interleave 32-bit lanes. The low unpack is lanes 00/11/44/55, and the
+  // high is 22/33/66/77.
+  __m256i ab_0145 = _mm256_unpacklo_epi32(vecs[0], vecs[1]);
+  __m256i ab_2367 = _mm256_unpackhi_epi32(vecs[0], vecs[1]);
+  __m256i cd_0145 = _mm256_unpacklo_epi32(vecs[2], vecs[3]);
+  __m256i cd_2367 = _mm256_unpackhi_epi32(vecs[2], vecs[3]);
+  __m256i ef_0145 = _mm256_unpacklo_epi32(vecs[4], vecs[5]);
+  __m256i ef_2367 = _mm256_unpackhi_epi32(vecs[4], vecs[5]);
+  __m256i gh_0145 = _mm256_unpacklo_epi32(vecs[6], vecs[7]);
+  __m256i gh_2367 = _mm256_unpackhi_epi32(vecs[6], vecs[7]);
+
+  // Interleave 64-bit lanes. The low unpack is lanes 00/22 and the high is
+  // 11/33.
+  __m256i abcd_04 = _mm256_unpacklo_epi64(ab_0145, cd_0145);
+  __m256i abcd_15 = _mm256_unpackhi_epi64(ab_0145, cd_0145);
+  __m256i abcd_26 = _mm256_unpacklo_epi64(ab_2367, cd_2367);
+  __m256i abcd_37 = _mm256_unpackhi_epi64(ab_2367, cd_2367);
+  __m256i efgh_04 = _mm256_unpacklo_epi64(ef_0145, gh_0145);
+  __m256i efgh_15 = _mm256_unpackhi_epi64(ef_0145, gh_0145);
+  __m256i efgh_26 = _mm256_unpacklo_epi64(ef_2367, gh_2367);
+  __m256i efgh_37 = _mm256_unpackhi_epi64(ef_2367, gh_2367);
+
+  // Interleave 128-bit lanes.
+  vecs[0] = _mm256_permute2x128_si256(abcd_04, efgh_04, 0x20);
+  vecs[1] = _mm256_permute2x128_si256(abcd_15, efgh_15, 0x20);
+  vecs[2] = _mm256_permute2x128_si256(abcd_26, efgh_26, 0x20);
+  vecs[3] = _mm256_permute2x128_si256(abcd_37, efgh_37, 0x20);
+  vecs[4] = _mm256_permute2x128_si256(abcd_04, efgh_04, 0x31);
+  vecs[5] = _mm256_permute2x128_si256(abcd_15, efgh_15, 0x31);
+  vecs[6] = _mm256_permute2x128_si256(abcd_26, efgh_26, 0x31);
+  vecs[7] = _mm256_permute2x128_si256(abcd_37, efgh_37, 0x31);
+}
+
+INLINE void transpose_msg_vecs8_avx2(const uint8_t *const *inputs,
+                                     size_t block_offset, __m256i out[16]) {
+  for (size_t i = 0; i < DEGREE_AVX2; i++) {
+    out[i] = loadu_avx2(&inputs[i][block_offset + 0 * sizeof(__m256i)]);
+    out[i + 8] = loadu_avx2(&inputs[i][block_offset + 1 * sizeof(__m256i)]);
+  }
+  for (size_t i = 0; i < DEGREE_AVX2; i++) {
+    _mm_prefetch((const void *)&inputs[i][block_offset + 256], _MM_HINT_T0);
+  }
+  transpose_vecs_avx2(&out[0]);
+  transpose_vecs_avx2(&out[8]);
+}
+
+INLINE void load_counters8_avx2(uint64_t counter, bool increment_counter,
+                                __m256i *out_lo, __m256i *out_hi) {
+  uint64_t mask = (increment_counter ? ~0 : 0);
+  uint32_t lo[DEGREE_AVX2], hi[DEGREE_AVX2];
+  for (size_t i = 0; i < DEGREE_AVX2; i++) {
+    lo[i] = counter_low(counter + (mask & i));
+    hi[i] = counter_high(counter + (mask & i));
+  }
+  *out_lo = loadu_avx2((const uint8_t *)lo);
+  *out_hi = loadu_avx2((const uint8_t *)hi);
+}
+
+void blake3_hash8_avx2(const uint8_t *const *inputs, size_t blocks,
+                       const uint32_t key[8], uint64_t counter,
+                       bool increment_counter, uint8_t flags,
+                       uint8_t flags_start, uint8_t flags_end, uint8_t *out) {
+  __m256i h_vecs[8] = {
+      set1_avx2(key[0]), set1_avx2(key[1]), set1_avx2(key[2]),
+      set1_avx2(key[3]), set1_avx2(key[4]), set1_avx2(key[5]),
+      set1_avx2(key[6]), set1_avx2(key[7]),
+  };
+  __m256i counter_low_vec, counter_high_vec;
+  load_counters8_avx2(counter, increment_counter, &counter_low_vec,
+                      &counter_high_vec);
+  uint8_t block_flags = flags | flags_start;
+
+  for (size_t block = 0; block < blocks; block++) {
+    if (block + 1 == blocks) {
+      block_flags |= flags_end;
+    }
+    __m256i block_len_vec = set1_avx2(BLAKE3_BLOCK_LEN);
+    __m256i block_flags_vec = set1_avx2(block_flags);
+    __m256i msg_vecs[16];
+    transpose_msg_vecs8_avx2(inputs, block * BLAKE3_BLOCK_LEN, msg_vecs);
+
+    __m256i v[16] = {
+        h_vecs[0],         h_vecs[1],         h_vecs[2],
+        h_vecs[3],         h_vecs[4],         h_vecs[5],
+        h_vecs[6],         h_vecs[7],         set1_avx2(IV[0]),
+        set1_avx2(IV[1]),  set1_avx2(IV[2]),  set1_avx2(IV[3]),
+        counter_low_vec,   counter_high_vec,  block_len_vec,
+        block_flags_vec,
+    };
+    round_fn8_avx2(v, msg_vecs, 0);
+    round_fn8_avx2(v, msg_vecs, 1);
+    round_fn8_avx2(v, msg_vecs, 2);
+    round_fn8_avx2(v, msg_vecs, 3);
+    round_fn8_avx2(v, msg_vecs, 4);
+    round_fn8_avx2(v, msg_vecs, 5);
+    round_fn8_avx2(v, msg_vecs, 6);
+    h_vecs[0] = xor_avx2(v[0], v[8]);
+    h_vecs[1] = xor_avx2(v[1], v[9]);
+    h_vecs[2] = xor_avx2(v[2], v[10]);
+    h_vecs[3] = xor_avx2(v[3], v[11]);
+    h_vecs[4] = xor_avx2(v[4], v[12]);
+    h_vecs[5] = xor_avx2(v[5], v[13]);
+    h_vecs[6] = xor_avx2(v[6], v[14]);
+    h_vecs[7] = xor_avx2(v[7], v[15]);
+
+    block_flags = flags;
+  }
+
+  // After the transpose each vec holds the full 32-byte output of one input.
+  transpose_vecs_avx2(h_vecs);
+  for (size_t i = 0; i < DEGREE_AVX2; i++) {
+    storeu_avx2(h_vecs[i], &out[i * sizeof(__m256i)]);
+  }
+}
+
+/*
+ * ----------------------------------------------------------------------------
+ * hash_many_avx2
+ * ----------------------------------------------------------------------------
+ */
+
+void blake3_hash_many_avx2(const uint8_t *const *inputs, size_t num_inputs,
+                           size_t blocks, const uint32_t key[8],
+                           uint64_t counter, bool increment_counter,
+                           uint8_t flags, uint8_t flags_start,
+                           uint8_t flags_end, uint8_t *out) {
+  while (num_inputs >= DEGREE_AVX2) {
+    blake3_hash8_avx2(inputs, blocks, key, counter, increment_counter, flags,
+                      flags_start, flags_end, out);
+    if (increment_counter) {
+      counter += DEGREE_AVX2;
+    }
+    inputs += DEGREE_AVX2;
+    num_inputs -= DEGREE_AVX2;
+    out = &out[DEGREE_AVX2 * BLAKE3_OUT_LEN];
+  }
+#if !defined(BLAKE3_NO_SSE41)
+  blake3_hash_many_sse41(inputs, num_inputs, blocks, key, counter,
+                         increment_counter, flags, flags_start, flags_end, out);
+#else
+  blake3_hash_many_portable(inputs, num_inputs, blocks, key, counter,
+                            increment_counter, flags, flags_start, flags_end,
+                            out);
+#endif
+}
+
+#if defined(__clang__)
+#pragma clang attribute pop
+#elif defined(__GNUC__)
+#pragma GCC pop_options
+#endif
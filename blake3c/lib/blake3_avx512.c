@@ -0,0 +1,444 @@
+//go:build amd64
+
+#include "blake3_impl.h"
+
+#include <immintrin.h>
+
+// Compiled for AVX-512F/VL only; see the note in blake3_sse41.c.
+#if defined(__clang__)
+#pragma clang attribute push(__attribute__((target("avx512f,avx512vl"))), apply_to = function)
+#elif defined(__GNUC__)
+#pragma GCC push_options
+#pragma GCC target("avx512f,avx512vl")
+#endif
+
+#define DEGREE_AVX512 16
+
+INLINE __m128i loadu_128_avx512(const uint8_t src[16]) {
+  return _mm_loadu_si128((const __m128i *)src);
+}
+
+INLINE void storeu_128_avx512(__m128i src, uint8_t dest[16]) {
+  _mm_storeu_si128((__m128i *)dest, src);
+}
+
+INLINE __m128i add_128_avx512(__m128i a, __m128i b) {
+  return _mm_add_epi32(a, b);
+}
+
+INLINE __m128i xor_128_avx512(__m128i a, __m128i b) {
+  return _mm_xor_si128(a, b);
+}
+
+INLINE __m128i set4_avx512(uint32_t a, uint32_t b, uint32_t c, uint32_t d) {
+  return _mm_setr_epi32((int32_t)a, (int32_t)b, (int32_t)c, (int32_t)d);
+}
+
+INLINE __m512i loadu_avx512(const uint8_t src[64]) {
+  return _mm512_loadu_si512((const void *)src);
+}
+
+INLINE __m512i add_avx512(__m512i a, __m512i b) {
+  return _mm512_add_epi32(a, b);
+}
+
+INLINE __m512i xor_avx512(__m512i a, __m512i b) {
+  return _mm512_xor_si512(a, b);
+}
+
+INLINE __m512i set1_avx512(uint32_t x) {
+  return _mm512_set1_epi32((int32_t)x);
+}
+
+INLINE __m512i rot16_avx512(__m512i x) { return _mm512_ror_epi32(x, 16); }
+
+INLINE __m512i rot12_avx512(__m512i x) { return _mm512_ror_epi32(x, 12); }
+
+INLINE __m512i rot8_avx512(__m512i x) { return _mm512_ror_epi32(x, 8); }
+
+INLINE __m512i rot7_avx512(__m512i x) { return _mm512_ror_epi32(x, 7); }
+
+/*
+ * ----------------------------------------------------------------------------
+ * compress_avx512
+ * ----------------------------------------------------------------------------
+ */
+
+// Same row layout as compress_sse41, using the AVX-512VL rotate instruction.
+
+INLINE void g1_avx512(__m128i *row0, __m128i *row1, __m128i *row2,
+                      __m128i *row3, __m128i m) {
+  *row0 = add_128_avx512(add_128_avx512(*row0, m), *row1);
+  *row3 = _mm_ror_epi32(xor_128_avx512(*row3, *row0), 16);
+  *row2 = add_128_avx512(*row2, *row3);
+  *row1 = _mm_ror_epi32(xor_128_avx512(*row1, *row2), 12);
+}
+
+INLINE void g2_avx512(__m128i *row0, __m128i *row1, __m128i *row2,
+                      __m128i *row3, __m128i m) {
+  *row0 = add_128_avx512(add_128_avx512(*row0, m), *row1);
+  *row3 = _mm_ror_epi32(xor_128_avx512(*row3, *row0), 8);
+  *row2 = add_128_avx512(*row2, *row3);
+  *row1 = _mm_ror_epi32(xor_128_avx512(*row1, *row2), 7);
+}
+
+INLINE void diagonalize_avx512(__m128i *row1, __m128i *row2, __m128i *row3) {
+  *row1 = _mm_shuffle_epi32(*row1, _MM_SHUFFLE(0, 3, 2, 1));
+  *row2 = _mm_shuffle_epi32(*row2, _MM_SHUFFLE(1, 0, 3, 2));
+  *row3 = _mm_shuffle_epi32(*row3, _MM_SHUFFLE(2, 1, 0, 3));
+}
+
+INLINE void undiagonalize_avx512(__m128i *row1, __m128i *row2, __m128i *row3) {
+  *row1 = _mm_shuffle_epi32(*row1, _MM_SHUFFLE(2, 1, 0, 3));
+  *row2 = _mm_shuffle_epi32(*row2, _MM_SHUFFLE(1, 0, 3, 2));
+  *row3 = _mm_shuffle_epi32(*row3, _MM_SHUFFLE(0, 3, 2, 1));
+}
+
+INLINE __m128i msg_avx512(const uint32_t m[16], const uint8_t *s, size_t i0,
+                          size_t i1, size_t i2, size_t i3) {
+  return set4_avx512(m[s[i0]], m[s[i1]], m[s[i2]], m[s[i3]]);
+}
+
+INLINE void compress_pre_avx512(__m128i rows[4], const uint32_t cv[8],
+                                const uint8_t block[BLAKE3_BLOCK_LEN],
+                                uint8_t block_len, uint64_t counter,
+                                uint8_t flags) {
+  uint32_t m[16];
+  load_block_words(block, m);
+
+  rows[0] = loadu_128_avx512((const uint8_t *)&cv[0]);
+  rows[1] = loadu_128_avx512((const uint8_t *)&cv[4]);
+  rows[2] = set4_avx512(IV[0], IV[1], IV[2], IV[3]);
+  rows[3] = set4_avx512(counter_low(counter), counter_high(counter),
+                        (uint32_t)block_len, (uint32_t)flags);
+
+  for (size_t r = 0; r < 7; r++) {
+    const uint8_t *s = MSG_SCHEDULE[r];
+    g1_avx512(&rows[0], &rows[1], &rows[2], &rows[3],
+              msg_avx512(m, s, 0, 2, 4, 6));
+    g2_avx512(&rows[0], &rows[1], &rows[2], &rows[3],
+              msg_avx512(m, s, 1, 3, 5, 7));
+    diagonalize_avx512(&rows[1], &rows[2], &rows[3]);
+    g1_avx512(&rows[0], &rows[1], &rows[2], &rows[3],
+              msg_avx512(m, s, 8, 10, 12, 14));
+    g2_avx512(&rows[0], &rows[1], &rows[2], &rows[3],
+              msg_avx512(m, s, 9, 11, 13, 15));
+    undiagonalize_avx512(&rows[1], &rows[2], &rows[3]);
+  }
+}
+
+void blake3_compress_in_place_avx512(uint32_t cv[8],
+                                     const uint8_t block[BLAKE3_BLOCK_LEN],
+                                     uint8_t block_len, uint64_t counter,
+                                     uint8_t flags) {
+  __m128i rows[4];
+  compress_pre_avx512(rows, cv, block, block_len, counter, flags);
+  storeu_128_avx512(xor_128_avx512(rows[0], rows[2]), (uint8_t *)&cv[0]);
+  storeu_128_avx512(xor_128_avx512(rows[1], rows[3]), (uint8_t *)&cv[4]);
+}
+
+void blake3_compress_xof_avx512(const uint32_t cv[8],
+                                const uint8_t block[BLAKE3_BLOCK_LEN],
+                                uint8_t block_len, uint64_t counter,
+                                uint8_t flags, uint8_t out[64]) {
+  __m128i rows[4];
+  compress_pre_avx512(rows, cv, block, block_len, counter, flags);
+  storeu_128_avx512(xor_128_avx512(rows[0], rows[2]), &out[0]);
+  storeu_128_avx512(xor_128_avx512(rows[1], rows[3]), &out[16]);
+  storeu_128_avx512(
+      xor_128_avx512(rows[2], loadu_128_avx512((const uint8_t *)&cv[0])),
+      &out[32]);
+  storeu_128_avx512(
+      xor_128_avx512(rows[3], loadu_128_avx512((const uint8_t *)&cv[4])),
+      &out[48]);
+}
+
+#if !defined(_WIN32)
+void blake3_xof_many_avx512(const uint32_t cv[8],
+                            const uint8_t block[BLAKE3_BLOCK_LEN],
+                            uint8_t block_len, uint64_t counter, uint8_t flags,
+                            uint8_t *out, size_t outblocks) {
+  for (size_t i = 0; i < outblocks; ++i) {
+    blake3_compress_xof_avx512(cv, block, block_len, counter + i, flags,
+                               out + 64 * i);
+  }
+}
+#endif
+
+/*
+ * ----------------------------------------------------------------------------
+ * hash16_avx512
+ * ----------------------------------------------------------------------------
+ */
+
+INLINE void round_fn16_avx512(__m512i v[16], __m512i m[16], size_t r) {
+  v[0] = add_avx512(v[0], m[(size_t)MSG_SCHEDULE[r][0]]);
+  v[1] = add_avx512(v[1], m[(size_t)MSG_SCHEDULE[r][2]]);
+  v[2] = add_avx512(v[2], m[(size_t)MSG_SCHEDULE[r][4]]);
+  v[3] = add_avx512(v[3], m[(size_t)MSG_SCHEDULE[r][6]]);
+  v[0] = add_avx512(v[0], v[4]);
+  v[1] = add_avx512(v[1], v[5]);
+  v[2] = add_avx512(v[2], v[6]);
+  v[3] = add_avx512(v[3], v[7]);
+  v[12] = xor_avx512(v[12], v[0]);
+  v[13] = xor_avx512(v[13], v[1]);
+  v[14] = xor_avx512(v[14], v[2]);
+  v[15] = xor_avx512(v[15], v[3]);
+  v[12] = rot16_avx512(v[12]);
+  v[13] = rot16_avx512(v[13]);
+  v[14] = rot16_avx512(v[14]);
+  v[15] = rot16_avx512(v[15]);
+  v[8] = add_avx512(v[8], v[12]);
+  v[9] = add_avx512(v[9], v[13]);
+  v[10] = add_avx512(v[10], v[14]);
+  v[11] = add_avx512(v[11], v[15]);
+  v[4] = xor_avx512(v[4], v[8]);
+  v[5] = xor_avx512(v[5], v[9]);
+  v[6] = xor_avx512(v[6], v[10]);
+  v[7] = xor_avx512(v[7], v[11]);
+  v[4] = rot12_avx512(v[4]);
+  v[5] = rot12_avx512(v[5]);
+  v[6] = rot12_avx512(v[6]);
+  v[7] = rot12_avx512(v[7]);
+  v[0] = add_avx512(v[0], m[(size_t)MSG_SCHEDULE[r][1]]);
+  v[1] = add_avx512(v[1], m[(size_t)MSG_SCHEDULE[r][3]]);
+  v[2] = add_avx512(v[2], m[(size_t)MSG_SCHEDULE[r][5]]);
+  v[3] = add_avx512(v[3], m[(size_t)MSG_SCHEDULE[r][7]]);
+  v[0] = add_avx512(v[0], v[4]);
+  v[1] = add_avx512(v[1], v[5]);
+  v[2] = add_avx512(v[2], v[6]);
+  v[3] = add_avx512(v[3], v[7]);
+  v[12] = xor_avx512(v[12], v[0]);
+  v[13] = xor_avx512(v[13], v[1]);
+  v[14] = xor_avx512(v[14], v[2]);
+  v[15] = xor_avx512(v[15], v[3]);
+  v[12] = rot8_avx512(v[12]);
+  v[13] = rot8_avx512(v[13]);
+  v[14] = rot8_avx512(v[14]);
+  v[15] = rot8_avx512(v[15]);
+  v[8] = add_avx512(v[8], v[12]);
+  v[9] = add_avx512(v[9], v[13]);
+  v[10] = add_avx512(v[10], v[14]);
+  v[11] = add_avx512(v[11], v[15]);
+  v[4] = xor_avx512(v[4], v[8]);
+  v[5] = xor_avx512(v[5], v[9]);
+  v[6] = xor_avx512(v[6], v[10]);
+  v[7] = xor_avx512(v[7], v[11]);
+  v[4] = rot7_avx512(v[4]);
+  v[5] = rot7_avx512(v[5]);
+  v[6] = rot7_avx512(v[6]);
+  v[7] = rot7_avx512(v[7]);
+
+  v[0] = add_avx512(v[0], m[(size_t)MSG_SCHEDULE[r][8]]);
+  v[1] = add_avx512(v[1], m[(size_t)MSG_SCHEDULE[r][10]]);
+  v[2] = add_avx512(v[2], m[(size_t)MSG_SCHEDULE[r][12]]);
+  v[3] = add_avx512(v[3], m[(size_t)MSG_SCHEDULE[r][14]]);
+  v[0] = add_avx512(v[0], v[5]);
+  v[1] = add_avx512(v[1], v[6]);
+  v[2] = add_avx512(v[2], v[7]);
+  v[3] = add_avx512(v[3], v[4]);
+  v[15] = xor_avx512(v[15], v[0]);
+  v[12] = xor_avx512(v[12], v[1]);
+  v[13] = xor_avx512(v[13], v[2]);
+  v[14] = xor_avx512(v[14], v[3]);
+  v[15] = rot16_avx512(v[15]);
+  v[12] = rot16_avx512(v[12]);
+  v[13] = rot16_avx512(v[13]);
+  v[14] = rot16_avx512(v[14]);
+  v[10] = add_avx512(v[10], v[15]);
+  v[11] = add_avx512(v[11], v[12]);
+  v[8] = add_avx512(v[8], v[13]);
+  v[9] = add_avx512(v[9], v[14]);
+  v[5] = xor_avx512(v[5], v[10]);
+  v[6] = xor_avx512(v[6], v[11]);
+  v[7] = xor_avx512(v[7], v[8]);
+  v[4] = xor_avx512(v[4], v[9]);
+  v[5] = rot12_avx512(v[5]);
+  v[6] = rot12_avx512(v[6]);
+  v[7] = rot12_avx512(v[7]);
+  v[4] = rot12_avx512(v[4]);
+  v[0] = add_avx512(v[0], m[(size_t)MSG_SCHEDULE[r][9]]);
+  v[1] = add_avx512(v[1], m[(size_t)MSG_SCHEDULE[r][11]]);
+  v[2] = add_avx512(v[2], m[(size_t)MSG_SCHEDULE[r][13]]);
+  v[3] = add_avx512(v[3], m[(size_t)MSG_SCHEDULE[r][15]]);
+  v[0] = add_avx512(v[0], v[5]);
+  v[1] = add_avx512(v[1], v[6]);
+  v[2] = add_avx512(v[2], v[7]);
+  v[3] = add_avx512(v[3], v[4]);
+  v[15] = xor_avx512(v[15], v[0]);
+  v[12] = xor_avx512(v[12], v[1]);
+  v[13] = xor_avx512(v[13], v[2]);
+  v[14] = xor_avx512(v[14], v[3]);
+  v[15] = rot8_avx512(v[15]);
+  v[12] = rot8_avx512(v[12]);
+  v[13] = rot8_avx512(v[13]);
+  v[14] = rot8_avx512(v[14]);
+  v[10] = add_avx512(v[10], v[15]);
+  v[11] = add_avx512(v[11], v[12]);
+  v[8] = add_avx512(v[8], v[13]);
+  v[9] = add_avx512(v[9], v[14]);
+  v[5] = xor_avx512(v[5], v[10]);
+  v[6] = xor_avx512(v[6], v[11]);
+  v[7] = xor_avx512(v[7], v[8]);
+  v[4] = xor_avx512(v[4], v[9]);
+  v[5] = rot7_avx512(v[5]);
+  v[6] = rot7_avx512(v[6]);
+  v[7] = rot7_avx512(v[7]);
+  v[4] = rot7_avx512(v[4]);
+}
+
+INLINE void transpose_msg_vecs16_avx512(const uint8_t *const *inputs,
+                                        size_t block_offset, __m512i out[16]) {
+  // Each input contributes one full 64-byte block, i.e. one row of a 16x16
+  // matrix of words.
+  __m512i rows[DEGREE_AVX512];
+  for (size_t i = 0; i < DEGREE_AVX512; i++) {
+    rows[i] = loadu_avx512(&inputs[i][block_offset]);
+    _mm_prefetch((const void *)&inputs[i][block_offset + 256], _MM_HINT_T0);
+  }
+
+  // Transpose 4x4 blocks of words inside every 128-bit lane. Afterwards
+  // w[4 * g + j] holds, in 128-bit lane l, word 4 * l + j of inputs
+  // 4 * g .. 4 * g + 3.
+  __m512i w[DEGREE_AVX512];
+  for (size_t g = 0; g < 4; g++) {
+    __m512i ab_lo = _mm512_unpacklo_epi32(rows[4 * g + 0], rows[4 * g + 1]);
+    __m512i ab_hi = _mm512_unpackhi_epi32(rows[4 * g + 0], rows[4 * g + 1]);
+    __m512i cd_lo = _mm512_unpacklo_epi32(rows[4 * g + 2], rows[4 * g + 3]);
+    __m512i cd_hi = _mm512_unpackhi_epi32(rows[4 * g + 2], rows[4 * g + 3]);
+    w[4 * g + 0] = _mm512_unpacklo_epi64(ab_lo, cd_lo);
+    w[4 * g + 1] = _mm512_unpackhi_epi64(ab_lo, cd_lo);
+    w[4 * g + 2] = _mm512_unpacklo_epi64(ab_hi, cd_hi);
+    w[4 * g + 3] = _mm512_unpackhi_epi64(ab_hi, cd_hi);
+  }
+
+  // Transpose the 4x4 matrix of 128-bit lanes for every word offset j.
+  for (size_t j = 0; j < 4; j++) {
+    __m512i ab_lo = _mm512_shuffle_i32x4(w[j], w[4 + j], 0x44);
+    __m512i ab_hi = _mm512_shuffle_i32x4(w[j], w[4 + j], 0xEE);
+    __m512i cd_lo = _mm512_shuffle_i32x4(w[8 + j], w[12 + j], 0x44);
+    __m512i cd_hi = _mm512_shuffle_i32x4(w[8 + j], w[12 + j], 0xEE);
+    out[0 + j] = _mm512_shuffle_i32x4(ab_lo, cd_lo, 0x88);
+    out[4 + j] = _mm512_shuffle_i32x4(ab_lo, cd_lo, 0xDD);
+    out[8 + j] = _mm512_shuffle_i32x4(ab_hi, cd_hi, 0x88);
+    out[12 + j] = _mm512_shuffle_i32x4(ab_hi, cd_hi, 0xDD);
+  }
+}
+
+INLINE void load_counters16_avx512(uint64_t counter, bool increment_counter,
+                                   __m512i *out_lo, __m512i *out_hi) {
+  uint64_t mask = (increment_counter ? ~0 : 0);
+  uint32_t lo[DEGREE_AVX512], hi[DEGREE_AVX512];
+  for (size_t i = 0; i < DEGREE_AVX512; i++) {
+    lo[i] = counter_low(counter + (mask & i));
+    hi[i] = counter_high(counter + (mask & i));
+  }
+  *out_lo = loadu_avx512((const uint8_t *)lo);
+  *out_hi = loadu_avx512((const uint8_t *)hi);
+}
+
+void blake3_hash16_avx512(const uint8_t *const *inputs, size_t blocks,
+                          const uint32_t key[8], uint64_t counter,
+                          bool increment_counter, uint8_t flags,
+                          uint8_t flags_start, uint8_t flags_end,
+                          uint8_t *out) {
+  __m512i h_vecs[8] = {
+      set1_avx512(key[0]), set1_avx512(key[1]), set1_avx512(key[2]),
+      set1_avx512(key[3]), set1_avx512(key[4]), set1_avx512(key[5]),
+      set1_avx512(key[6]), set1_avx512(key[7]),
+  };
+  __m512i counter_low_vec, counter_high_vec;
+  load_counters16_avx512(counter, increment_counter, &counter_low_vec,
+                         &counter_high_vec);
+  uint8_t block_flags = flags | flags_start;
+
+  for (size_t block = 0; block < blocks; block++) {
+    if (block + 1 == blocks) {
+      block_flags |= flags_end;
+    }
+    __m512i block_len_vec = set1_avx512(BLAKE3_BLOCK_LEN);
+    __m512i block_flags_vec = set1_avx512(block_flags);
+    __m512i msg_vecs[16];
+    transpose_msg_vecs16_avx512(inputs, block * BLAKE3_BLOCK_LEN, msg_vecs);
+
+    __m512i v[16] = {
+        h_vecs[0],           h_vecs[1],           h_vecs[2],
+        h_vecs[3],           h_vecs[4],           h_vecs[5],
+        h_vecs[6],           h_vecs[7],           set1_avx512(IV[0]),
+        set1_avx512(IV[1]),  set1_avx512(IV[2]),  set1_avx512(IV[3]),
+        counter_low_vec,     counter_high_vec,    block_len_vec,
+        block_flags_vec,
+    };
+    round_fn16_avx512(v, msg_vecs, 0);
+    round_fn16_avx512(v, msg_vecs, 1);
+    round_fn16_avx512(v, msg_vecs, 2);
+    round_fn16_avx512(v, msg_vecs, 3);
+    round_fn16_avx512(v, msg_vecs, 4);
+    round_fn16_avx512(v, msg_vecs, 5);
+    round_fn16_avx512(v, msg_vecs, 6);
+    h_vecs[0] = xor_avx512(v[0], v[8]);
+    h_vecs[1] = xor_avx512(v[1], v[9]);
+    h_vecs[2] = xor_avx512(v[2], v[10]);
+    h_vecs[3] = xor_avx512(v[3], v[11]);
+    h_vecs[4] = xor_avx512(v[4], v[12]);
+    h_vecs[5] = xor_avx512(v[5], v[13]);
+    h_vecs[6] = xor_avx512(v[6], v[14]);
+    h_vecs[7] = xor_avx512(v[7], v[15]);
+
+    block_flags = flags;
+  }
+
+  // Scatter the eight word vectors into sixteen 32-byte outputs. This runs
+  // once per sixteen chunks, so a plain store and copy is cheap enough.
+  uint32_t words[8][DEGREE_AVX512];
+  for (size_t w = 0; w < 8; w++) {
+    _mm512_storeu_si512((void *)words[w], h_vecs[w]);
+  }
+  for (size_t i = 0; i < DEGREE_AVX512; i++) {
+    for (size_t w = 0; w < 8; w++) {
+      store32(&out[i * BLAKE3_OUT_LEN + w * 4], words[w][i]);
+    }
+  }
+}
+
+/*
+ * ----------------------------------------------------------------------------
+ * hash_many_avx512
+ * ----------------------------------------------------------------------------
+ */
+
+void blake3_hash_many_avx512(const uint8_t *const *inputs, size_t num_inputs,
+                             size_t blocks, const uint32_t key[8],
+                             uint64_t counter, bool increment_counter,
+                             uint8_t flags, uint8_t flags_start,
+                             uint8_t flags_end, uint8_t *out) {
+  while (num_inputs >= DEGREE_AVX512) {
+    blake3_hash16_avx512(inputs, blocks, key, counter, increment_counter,
+                         flags, flags_start, flags_end, out);
+    if (increment_counter) {
+      counter += DEGREE_AVX512;
+    }
+    inputs += DEGREE_AVX512;
+    num_inputs -= DEGREE_AVX512;
+    out = &out[DEGREE_AVX512 * BLAKE3_OUT_LEN];
+  }
+  // Every CPU with AVX-512F also has AVX2, so the remainder goes down the
+  // narrower paths.
+#if !defined(BLAKE3_NO_AVX2)
+  blake3_hash_many_avx2(inputs, num_inputs, blocks, key, counter,
+                        increment_counter, flags, flags_start, flags_end, out);
+#elif !defined(BLAKE3_NO_SSE41)
+  blake3_hash_many_sse41(inputs, num_inputs, blocks, key, counter,
+                         increment_counter, flags, flags_start, flags_end, out);
+#else
+  blake3_hash_many_portable(inputs, num_inputs, blocks, key, counter,
+                            increment_counter, flags, flags_start, flags_end,
+                            out);
+#endif
+}
+
+#if defined(__clang__)
+#pragma clang attribute pop
+#elif defined(__GNUC__)
+#pragma GCC pop_options
+#endif
@@ -0,0 +1,426 @@
+//go:build amd64
+
+#include "blake3_impl.h"
+
+#include <immintrin.h>
+
+// The whole file is compiled for SSE4.1 while the rest of the library keeps
+// the baseline target; the dispatcher only calls in here after checking the
+// CPU features at runtime.
+#if defined(__clang__)
+#pragma clang attribute push(__attribute__((target("sse4.1"))), apply_to = function)
+#elif defined(__GNUC__)
+#pragma GCC push_options
+#pragma GCC target("sse4.1")
+#endif
+
+INLINE __m128i loadu_sse41(const uint8_t src[16]) {
+  return _mm_loadu_si128((const __m128i *)src);
+}
+
+INLINE void storeu_sse41(__m128i src, uint8_t dest[16]) {
+  _mm_storeu_si128((__m128i *)dest, src);
+}
+
+INLINE __m128i add_sse41(__m128i a, __m128i b) { return _mm_add_epi32(a, b); }
+
+INLINE __m128i xor_sse41(__m128i a, __m128i b) { return _mm_xor_si128(a, b); }
+
+INLINE __m128i set1_sse41(uint32_t x) { return _mm_set1_epi32((int32_t)x); }
+
+INLINE __m128i set4_sse41(uint32_t a, uint32_t b, uint32_t c, uint32_t d) {
+  return _mm_setr_epi32((int32_t)a, (int32_t)b, (int32_t)c, (int32_t)d);
+}
+
+INLINE __m128i rot16_sse41(__m128i x) {
+  return _mm_shuffle_epi8(
+      x, _mm_set_epi8(13, 12, 15, 14, 9, 8, 11, 10, 5, 4, 7, 6, 1, 0, 3, 2));
+}
+
+INLINE __m128i rot12_sse41(__m128i x) {
+  return _mm_or_si128(_mm_srli_epi32(x, 12), _mm_slli_epi32(x, 32 - 12));
+}
+
+INLINE __m128i rot8_sse41(__m128i x) {
+  return _mm_shuffle_epi8(
+      x, _mm_set_epi8(12, 15, 14, 13, 8, 11, 10, 9, 4, 7, 6, 5, 0, 3, 2, 1));
+}
+
+INLINE __m128i rot7_sse41(__m128i x) {
+  return _mm_or_si128(_mm_srli_epi32(x, 7), _mm_slli_epi32(x, 32 - 7));
+}
+
+/*
+ * ----------------------------------------------------------------------------
+ * compress_sse41
+ * ----------------------------------------------------------------------------
+ */
+
+// The state is kept as four rows of four words. Each round mixes the columns,
+// rotates rows 1-3 so the diagonals line up as columns, mixes again and
+// rotates back.
+
+INLINE void g1_sse41(__m128i *row0, __m128i *row1, __m128i *row2,
+                     __m128i *row3, __m128i m) {
+  *row0 = add_sse41(add_sse41(*row0, m), *row1);
+  *row3 = rot16_sse41(xor_sse41(*row3, *row0));
+  *row2 = add_sse41(*row2, *row3);
+  *row1 = rot12_sse41(xor_sse41(*row1, *row2));
+}
+
+INLINE void g2_sse41(__m128i *row0, __m128i *row1, __m128i *row2,
+                     __m128i *row3, __m128i m) {
+  *row0 = add_sse41(add_sse41(*row0, m), *row1);
+  *row3 = rot8_sse41(xor_sse41(*row3, *row0));
+  *row2 = add_sse41(*row2, *row3);
+  *row1 = rot7_sse41(xor_sse41(*row1, *row2));
+}
+
+INLINE void diagonalize_sse41(__m128i *row1, __m128i *row2, __m128i *row3) {
+  *row1 = _mm_shuffle_epi32(*row1, _MM_SHUFFLE(0, 3, 2, 1));
+  *row2 = _mm_shuffle_epi32(*row2, _MM_SHUFFLE(1, 0, 3, 2));
+  *row3 = _mm_shuffle_epi32(*row3, _MM_SHUFFLE(2, 1, 0, 3));
+}
+
+INLINE void undiagonalize_sse41(__m128i *row1, __m128i *row2, __m128i *row3) {
+  *row1 = _mm_shuffle_epi32(*row1, _MM_SHUFFLE(2, 1, 0, 3));
+  *row2 = _mm_shuffle_epi32(*row2, _MM_SHUFFLE(1, 0, 3, 2));
+  *row3 = _mm_shuffle_epi32(*row3, _MM_SHUFFLE(0, 3, 2, 1));
+}
+
+INLINE __m128i msg_sse41(const uint32_t m[16], const uint8_t *s, size_t i0,
+                         size_t i1, size_t i2, size_t i3) {
+  return set4_sse41(m[s[i0]], m[s[i1]], m[s[i2]], m[s[i3]]);
+}
+
+INLINE void compress_pre_sse41(__m128i rows[4], const uint32_t cv[8],
+                               const uint8_t block[BLAKE3_BLOCK_LEN],
+                               uint8_t block_len, uint64_t counter,
+                               uint8_t flags) {
+  uint32_t m[16];
+  load_block_words(block, m);
+
+  rows[0] = loadu_sse41((const uint8_t *)&cv[0]);
+  rows[1] = loadu_sse41((const uint8_t *)&cv[4]);
+  rows[2] = set4_sse41(IV[0], IV[1], IV[2], IV[3]);
+  rows[3] = set4_sse41(counter_low(counter), counter_high(counter),
+                       (uint32_t)block_len, (uint32_t)flags);
+
+  for (size_t r = 0; r < 7; r++) {
+    const uint8_t *s = MSG_SCHEDULE[r];
+    g1_sse41(&rows[0], &rows[1], &rows[2], &rows[3], msg_sse41(m, s, 0, 2, 4, 6));
+    g2_sse41(&rows[0], &rows[1], &rows[2], &rows[3], msg_sse41(m, s, 1, 3, 5, 7));
+    diagonalize_sse41(&rows[1], &rows[2], &rows[3]);
+    g1_sse41(&rows[0], &rows[1], &rows[2], &rows[3],
+             msg_sse41(m, s, 8, 10, 12, 14));
+    g2_sse41(&rows[0], &rows[1], &rows[2], &rows[3],
+             msg_sse41(m, s, 9, 11, 13, 15));
+    undiagonalize_sse41(&rows[1], &rows[2], &rows[3]);
+  }
+}
+
+void blake3_compress_in_place_sse41(uint32_t cv[8],
+                                    const uint8_t block[BLAKE3_BLOCK_LEN],
+                                    uint8_t block_len, uint64_t counter,
+                                    uint8_t flags) {
+  __m128i rows[4];
+  compress_pre_sse41(rows, cv, block, block_len, counter, flags);
+  storeu_sse41(xor_sse41(rows[0], rows[2]), (uint8_t *)&cv[0]);
+  storeu_sse41(xor_sse41(rows[1], rows[3]), (uint8_t *)&cv[4]);
+}
+
+void blake3_compress_xof_sse41(const uint32_t cv[8],
+                               const uint8_t block[BLAKE3_BLOCK_LEN],
+                               uint8_t block_len, uint64_t counter,
+                               uint8_t flags, uint8_t out[64]) {
+  __m128i rows[4];
+  compress_pre_sse41(rows, cv, block, block_len, counter, flags);
+  storeu_sse41(xor_sse41(rows[0], rows[2]), &out[0]);
+  storeu_sse41(xor_sse41(rows[1], rows[3]), &out[16]);
+  storeu_sse41(xor_sse41(rows[2], loadu_sse41((const uint8_t *)&cv[0])),
+               &out[32]);
+  storeu_sse41(xor_sse41(rows[3], loadu_sse41((const uint8_t *)&cv[4])),
+               &out[48]);
+}
+
+/*
+ * ----------------------------------------------------------------------------
+ * hash4_sse41
+ * ----------------------------------------------------------------------------
+ */
+
+INLINE void round_fn4_sse41(__m128i v[16], __m128i m[16], size_t r) {
+  v[0] = add_sse41(v[0], m[(size_t)MSG_SCHEDULE[r][0]]);
+  v[1] = add_sse41(v[1], m[(size_t)MSG_SCHEDULE[r][2]]);
+  v[2] = add_sse41(v[2], m[(size_t)MSG_SCHEDULE[r][4]]);
+  v[3] = add_sse41(v[3], m[(size_t)MSG_SCHEDULE[r][6]]);
+  v[0] = add_sse41(v[0], v[4]);
+  v[1] = add_sse41(v[1], v[5]);
+  v[2] = add_sse41(v[2], v[6]);
+  v[3] = add_sse41(v[3], v[7]);
+  v[12] = xor_sse41(v[12], v[0]);
+  v[13] = xor_sse41(v[13], v[1]);
+  v[14] = xor_sse41(v[14], v[2]);
+  v[15] = xor_sse41(v[15], v[3]);
+  v[12] = rot16_sse41(v[12]);
+  v[13] = rot16_sse41(v[13]);
+  v[14] = rot16_sse41(v[14]);
+  v[15] = rot16_sse41(v[15]);
+  v[8] = add_sse41(v[8], v[12]);
+  v[9] = add_sse41(v[9], v[13]);
+  v[10] = add_sse41(v[10], v[14]);
+  v[11] = add_sse41(v[11], v[15]);
+  v[4] = xor_sse41(v[4], v[8]);
+  v[5] = xor_sse41(v[5], v[9]);
+  v[6] = xor_sse41(v[6], v[10]);
+  v[7] = xor_sse41(v[7], v[11]);
+  v[4] = rot12_sse41(v[4]);
+  v[5] = rot12_sse41(v[5]);
+  v[6] = rot12_sse41(v[6]);
+  v[7] = rot12_sse41(v[7]);
+  v[0] = add_sse41(v[0], m[(size_t)MSG_SCHEDULE[r][1]]);
+  v[1] = add_sse41(v[1], m[(size_t)MSG_SCHEDULE[r][3]]);
+  v[2] = add_sse41(v[2], m[(size_t)MSG_SCHEDULE[r][5]]);
+  v[3] = add_sse41(v[3], m[(size_t)MSG_SCHEDULE[r][7]]);
+  v[0] = add_sse41(v[0], v[4]);
+  v[1] = add_sse41(v[1], v[5]);
+  v[2] = add_sse41(v[2], v[6]);
+  v[3] = add_sse41(v[3], v[7]);
+  v[12] = xor_sse41(v[12], v[0]);
+  v[13] = xor_sse41(v[13], v[1]);
+  v[14] = xor_sse41(v[14], v[2]);
+  v[15] = xor_sse41(v[15], v[3]);
+  v[12] = rot8_sse41(v[12]);
+  v[13] = rot8_sse41(v[13]);
+  v[14] = rot8_sse41(v[14]);
+  v[15] = rot8_sse41(v[15]);
+  v[8] = add_sse41(v[8], v[12]);
+  v[9] = add_sse41(v[9], v[13]);
+  v[10] = add_sse41(v[10], v[14]);
+  v[11] = add_sse41(v[11], v[15]);
+  v[4] = xor_sse41(v[4], v[8]);
+  v[5] = xor_sse41(v[5], v[9]);
+  v[6] = xor_sse41(v[6], v[10]);
+  v[7] = xor_sse41(v[7], v[11]);
+  v[4] = rot7_sse41(v[4]);
+  v[5] = rot7_sse41(v[5]);
+  v[6] = rot7_sse41(v[6]);
+  v[7] = rot7_sse41(v[7]);
+
+  v[0] = add_sse41(v[0], m[(size_t)MSG_SCHEDULE[r][8]]);
+  v[1] = add_sse41(v[1], m[(size_t)MSG_SCHEDULE[r][10]]);
+  v[2] = add_sse41(v[2], m[(size_t)MSG_SCHEDULE[r][12]]);
+  v[3] = add_sse41(v[3], m[(size_t)MSG_SCHEDULE[r][14]]);
+  v[0] = add_sse41(v[0], v[5]);
+  v[1] = add_sse41(v[1], v[6]);
+  v[2] = add_sse41(v[2], v[7]);
+  v[3] = add_sse41(v[3], v[4]);
+  v[15] = xor_sse41(v[15], v[0]);
+  v[12] = xor_sse41(v[12], v[1]);
+  v[13] = xor_sse41(v[13], v[2]);
+  v[14] = xor_sse41(v[14], v[3]);
+  v[15] = rot16_sse41(v[15]);
+  v[12] = rot16_sse41(v[12]);
+  v[13] = rot16_sse41(v[13]);
+  v[14] = rot16_sse41(v[14]);
+  v[10] = add_sse41(v[10], v[15]);
+  v[11] = add_sse41(v[11], v[12]);
+  v[8] = add_sse41(v[8], v[13]);
+  v[9] = add_sse41(v[9], v[14]);
+  v[5] = xor_sse41(v[5], v[10]);
+  v[6] = xor_sse41(v[6], v[11]);
+  v[7] = xor_sse41(v[7], v[8]);
+  v[4] = xor_sse41(v[4], v[9]);
+  v[5] = rot12_sse41(v[5]);
+  v[6] = rot12_sse41(v[6]);
+  v[7] = rot12_sse41(v[7]);
+  v[4] = rot12_sse41(v[4]);
+  v[0] = add_sse41(v[0], m[(size_t)MSG_SCHEDULE[r][9]]);
+  v[1] = add_sse41(v[1], m[(size_t)MSG_SCHEDULE[r][11]]);
+  v[2] = add_sse41(v[2], m[(size_t)MSG_SCHEDULE[r][13]]);
+  v[3] = add_sse41(v[3], m[(size_t)MSG_SCHEDULE[r][15]]);
+  v[0] = add_sse41(v[0], v[5]);
+  v[1] = add_sse41(v[1], v[6]);
+  v[2] = add_sse41(v[2], v[7]);
+  v[3] = add_sse41(v[3], v[4]);
+  v[15] = xor_sse41(v[15], v[0]);
+  v[12] = xor_sse41(v[12], v[1]);
+  v[13] = xor_sse41(v[13], v[2]);
+  v[14] = xor_sse41(v[14], v[3]);
+  v[15] = rot8_sse41(v[15]);
+  v[12] = rot8_sse41(v[12]);
+  v[13] = rot8_sse41(v[13]);
+  v[14] = rot8_sse41(v[14]);
+  v[10] = add_sse41(v[10], v[15]);
+  v[11] = add_sse41(v[11], v[12]);
+  v[8] = add_sse41(v[8], v[13]);
+  v[9] = add_sse41(v[9], v[14]);
+  v[5] = xor_sse41(v[5], v[10]);
+  v[6] = xor_sse41(v[6], v[11]);
+  v[7] = xor_sse41(v[7], v[8]);
+  v[4] = xor_sse41(v[4], v[9]);
+  v[5] = rot7_sse41(v[5]);
+  v[6] = rot7_sse41(v[6]);
+  v[7] = rot7_sse41(v[7]);
+  v[4] = rot7_sse41(v[4]);
+}
+
+INLINE void transpose_vecs_sse41(__m128i vecs[4]) {
+  // Interleave 32-bit lanes, then 64-bit lanes.
+  __m128i ab_01 = _mm_unpacklo_epi32(vecs[0], vecs[1]);
+  __m128i ab_23 = _mm_unpackhi_epi32(vecs[0], vecs[1]);
+  __m128i cd_01 = _mm_unpacklo_epi32(vecs[2], vecs[3]);
+  __m128i cd_23 = _mm_unpackhi_epi32(vecs[2], vecs[3]);
+  vecs[0] = _mm_unpacklo_epi64(ab_01, cd_01);
+  vecs[1] = _mm_unpackhi_epi64(ab_01, cd_01);
+  vecs[2] = _mm_unpacklo_epi64(ab_23, cd_23);
+  vecs[3] = _mm_unpackhi_epi64(ab_23, cd_23);
+}
+
+INLINE void transpose_msg_vecs4_sse41(const uint8_t *const *inputs,
+                                      size_t block_offset, __m128i out[16]) {
+  for (size_t i = 0; i < 4; i++) {
+    for (size_t j = 0; j < 4; j++) {
+      out[4 * i + j] =
+          loadu_sse41(&inputs[j][block_offset + i * sizeof(__m128i)]);
+    }
+  }
+  transpose_vecs_sse41(&out[0]);
+  transpose_vecs_sse41(&out[4]);
+  transpose_vecs_sse41(&out[8]);
+  transpose_vecs_sse41(&out[12]);
+}
+
+INLINE void load_counters4_sse41(uint64_t counter, bool increment_counter,
+                                 __m128i *out_low, __m128i *out_high) {
+  uint64_t mask = (increment_counter ? ~0 : 0);
+  *out_low = set4_sse41(
+      counter_low(counter + (mask & 0)), counter_low(counter + (mask & 1)),
+      counter_low(counter + (mask & 2)), counter_low(counter + (mask & 3)));
+  *out_high = set4_sse41(
+      counter_high(counter + (mask & 0)), counter_high(counter + (mask & 1)),
+      counter_high(counter + (mask & 2)), counter_high(counter + (mask & 3)));
+}
+
+void blake3_hash4_sse41(const uint8_t *const *inputs, size_t blocks,
+                        const uint32_t key[8], uint64_t counter,
+                        bool increment_counter, uint8_t flags,
+                        uint8_t flags_start, uint8_t flags_end, uint8_t *out) {
+  __m128i h_vecs[8] = {
+      set1_sse41(key[0]), set1_sse41(key[1]), set1_sse41(key[2]),
+      set1_sse41(key[3]), set1_sse41(key[4]), set1_sse41(key[5]),
+      set1_sse41(key[6]), set1_sse41(key[7]),
+  };
+  __m128i counter_low_vec, counter_high_vec;
+  load_counters4_sse41(counter, increment_counter, &counter_low_vec,
+                       &counter_high_vec);
+  uint8_t block_flags = flags | flags_start;
+
+  for (size_t block = 0; block < blocks; block++) {
+    if (block + 1 == blocks) {
+      block_flags |= flags_end;
+    }
+    __m128i block_len_vec = set1_sse41(BLAKE3_BLOCK_LEN);
+    __m128i block_flags_vec = set1_sse41(block_flags);
+    __m128i msg_vecs[16];
+    transpose_msg_vecs4_sse41(inputs, block * BLAKE3_BLOCK_LEN, msg_vecs);
+
+    __m128i v[16] = {
+        h_vecs[0],          h_vecs[1],          h_vecs[2],
+        h_vecs[3],          h_vecs[4],          h_vecs[5],
+        h_vecs[6],          h_vecs[7],          set1_sse41(IV[0]),
+        set1_sse41(IV[1]),  set1_sse41(IV[2]),  set1_sse41(IV[3]),
+        counter_low_vec,    counter_high_vec,   block_len_vec,
+        block_flags_vec,
+    };
+    round_fn4_sse41(v, msg_vecs, 0);
+    round_fn4_sse41(v, msg_vecs, 1);
+    round_fn4_sse41(v, msg_vecs, 2);
+    round_fn4_sse41(v, msg_vecs, 3);
+    round_fn4_sse41(v, msg_vecs, 4);
+    round_fn4_sse41(v, msg_vecs, 5);
+    round_fn4_sse41(v, msg_vecs, 6);
+    h_vecs[0] = xor_sse41(v[0], v[8]);
+    h_vecs[1] = xor_sse41(v[1], v[9]);
+    h_vecs[2] = xor_sse41(v[2], v[10]);
+    h_vecs[3] = xor_sse41(v[3], v[11]);
+    h_vecs[4] = xor_sse41(v[4], v[12]);
+    h_vecs[5] = xor_sse41(v[5], v[13]);
+    h_vecs[6] = xor_sse41(v[6], v[14]);
+    h_vecs[7] = xor_sse41(v[7], v[15]);
+
+    block_flags = flags;
+  }
+
+  transpose_vecs_sse41(&h_vecs[0]);
+  transpose_vecs_sse41(&h_vecs[4]);
+  // The first four vecs now contain the first half of each output, and the
+  // second four vecs contain the second half of each output.
+  storeu_sse41(h_vecs[0], &out[0 * sizeof(__m128i)]);
+  storeu_sse41(h_vecs[4], &out[1 * sizeof(__m128i)]);
+  storeu_sse41(h_vecs[1], &out[2 * sizeof(__m128i)]);
+  storeu_sse41(h_vecs[5], &out[3 * sizeof(__m128i)]);
+  storeu_sse41(h_vecs[2], &out[4 * sizeof(__m128i)]);
+  storeu_sse41(h_vecs[6], &out[5 * sizeof(__m128i)]);
+  storeu_sse41(h_vecs[3], &out[6 * sizeof(__m128i)]);
+  storeu_sse41(h_vecs[7], &out[7 * sizeof(__m128i)]);
+}
+
+/*
+ * ----------------------------------------------------------------------------
+ * hash_many_sse41
+ * ----------------------------------------------------------------------------
+ */
+
+INLINE void hash_one_sse41(const uint8_t *input, size_t blocks,
+                           const uint32_t key[8], uint64_t counter,
+                           uint8_t flags, uint8_t flags_start,
+                           uint8_t flags_end, uint8_t out[BLAKE3_OUT_LEN]) {
+  uint32_t cv[8];
+  memcpy(cv, key, BLAKE3_KEY_LEN);
+  uint8_t block_flags = flags | flags_start;
+  while (blocks > 0) {
+    if (blocks == 1) {
+      block_flags |= flags_end;
+    }
+    blake3_compress_in_place_sse41(cv, input, BLAKE3_BLOCK_LEN, counter,
+                                   block_flags);
+    input = &input[BLAKE3_BLOCK_LEN];
+    blocks -= 1;
+    block_flags = flags;
+  }
+  memcpy(out, cv, BLAKE3_OUT_LEN);
+}
+
+void blake3_hash_many_sse41(const uint8_t *const *inputs, size_t num_inputs,
+                            size_t blocks, const uint32_t key[8],
+                            uint64_t counter, bool increment_counter,
+                            uint8_t flags, uint8_t flags_start,
+                            uint8_t flags_end, uint8_t *out) {
+  while (num_inputs >= 4) {
+    blake3_hash4_sse41(inputs, blocks, key, counter, increment_counter, flags,
+                       flags_start, flags_end, out);
+    if (increment_counter) {
+      counter += 4;
+    }
+    inputs += 4;
+    num_inputs -= 4;
+    out = &out[4 * BLAKE3_OUT_LEN];
+  }
+  while (num_inputs > 0) {
+    hash_one_sse41(inputs[0], blocks, key, counter, flags, flags_start,
+                   flags_end, out);
+    if (increment_counter) {
+      counter += 1;
+    }
+    inputs += 1;
+    num_inputs -= 1;
+    out = &out[BLAKE3_OUT_LEN];
+  }
+}
+
+#if defined(__clang__)
+#pragma clang attribute pop
+#elif defined(__GNUC__)
+#pragma GCC pop_options
+#endif
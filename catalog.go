@@ -0,0 +1,719 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// catalogPath, when set, keeps checksums and their history in this SQLite
+// database instead of a list.
+var catalogPath string
+
+var errNoCatalog = errors.New("-db is not available: this build has no SQLite driver, which needs cgo")
+
+// catalogSchema creates the catalog tables. Every generate or verify is a
+// run; each file it hashed, or found missing, gets an observation. The
+// reference checksum of a file is its latest HASHED observation with the
+// run's algorithm.
+const catalogSchema = `
+CREATE TABLE IF NOT EXISTS runs (
+	id       INTEGER PRIMARY KEY,
+	mode     TEXT NOT NULL,  -- generate or verify
+	dir      TEXT NOT NULL,  -- absolute
+	algo     TEXT NOT NULL,
+	tool     TEXT NOT NULL,
+	started  TEXT NOT NULL,  -- RFC 3339, UTC
+	finished TEXT            -- NULL while running or after an interruption
+);
+CREATE TABLE IF NOT EXISTS files (
+	id   INTEGER PRIMARY KEY,
+	path TEXT NOT NULL UNIQUE -- absolute
+);
+CREATE TABLE IF NOT EXISTS observations (
+	run_id   INTEGER NOT NULL REFERENCES runs(id),
+	file_id  INTEGER NOT NULL REFERENCES files(id),
+	status   TEXT NOT NULL,  -- HASHED for generate, a verify status otherwise
+	hash     TEXT,           -- NULL if the file could not be hashed
+	size     INTEGER,
+	mtime    INTEGER,        -- Unix nanoseconds
+	error    TEXT,
+	observed TEXT NOT NULL,  -- RFC 3339, UTC
+	PRIMARY KEY (run_id, file_id)
+);
+CREATE INDEX IF NOT EXISTS observations_file ON observations(file_id, run_id);
+`
+
+// catalogBatch is how many observations are committed at a time, so that
+// an interrupted run loses at most that many.
+const catalogBatch = 1000
+
+// catalog is an open catalog database.
+type catalog struct {
+	db *sql.DB
+}
+
+// openCatalog opens the catalog at path, creating it if need be.
+func openCatalog(path string) (*catalog, error) {
+	if !catalogSupported {
+		return nil, errNoCatalog
+	}
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	// One connection keeps the pragmas in force and writers serialised.
+	db.SetMaxOpenConns(1)
+	for _, q := range []string{"PRAGMA journal_mode = WAL", "PRAGMA synchronous = NORMAL", "PRAGMA foreign_keys = ON", catalogSchema} {
+		if _, err := db.Exec(q); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return &catalog{db: db}, nil
+}
+
+func (c *catalog) close() error { return c.db.Close() }
+
+// catalogStage is the temporary schema a run works in: the regular files
+// found under its directory, the reference checksums of the files under
+// it and the files it hashes. Temporary tables belong to the connection,
+// which is the only one.
+const catalogStage = `
+CREATE TEMP TABLE IF NOT EXISTS walk (path TEXT PRIMARY KEY, size INTEGER, mtime INTEGER);
+CREATE TEMP TABLE IF NOT EXISTS ref (path TEXT PRIMARY KEY, hash TEXT, size INTEGER, mtime INTEGER);
+CREATE TEMP TABLE IF NOT EXISTS todo (path TEXT NOT NULL, hash TEXT, size INTEGER, mtime INTEGER);
+DELETE FROM walk;
+DELETE FROM ref;
+DELETE FROM todo;
+`
+
+// stage fills walk with the regular files under dir, an absolute path,
+// except the catalog's own, and ref with the reference checksums with algo
+// of the files under dir. The walk is inserted as it goes, in a single
+// transaction, so no list of the files is held in memory.
+func (c *catalog) stage(ctx context.Context, dir, algo string) error {
+	if _, err := c.db.Exec(catalogStage); err != nil {
+		return err
+	}
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	insert, err := tx.Prepare(`INSERT INTO walk (path, size, mtime) VALUES (?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	own := catalogFiles()
+	err = walkEntries(ctx, dir, func(p string, d os.DirEntry) error {
+		if !d.Type().IsRegular() || own[p] {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		_, err = insert.Exec(p, fi.Size(), fi.ModTime().UnixNano())
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	// Paths under dir sort between dir+"/" and dir+"0", '0' following '/',
+	// which lets the path index narrow the scan. With MAX(), SQLite takes
+	// the other columns from the row holding the maximum, here the latest
+	// run.
+	prefix := strings.TrimSuffix(dir, string(filepath.Separator)) + string(filepath.Separator)
+	if _, err := tx.Exec(`
+		INSERT INTO ref (path, hash, size, mtime)
+		SELECT path, hash, size, mtime FROM (
+			SELECT f.path, o.hash, o.size, o.mtime, MAX(o.run_id)
+			FROM observations o JOIN files f ON f.id = o.file_id JOIN runs r ON r.id = o.run_id
+			WHERE r.algo = ? AND o.status = 'HASHED' AND f.path > ? AND f.path < ?
+			GROUP BY o.file_id)`,
+		algo, prefix, prefix[:len(prefix)-1]+string(filepath.Separator+1)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// catalogFile is a file of todo: its size and mtime as walked when
+// generating, its reference checksum with the size and mtime recorded
+// with it when verifying.
+type catalogFile struct {
+	row         int64
+	path, hash  string
+	size, mtime int64
+}
+
+// hashTodo hashes the files of todo on the worker pool, reading them a
+// page at a time between the batches of w, and hands each to fn. It
+// returns how many files todo holds and how many were handed out, fewer if
+// ctx was cancelled.
+func (c *catalog) hashTodo(ctx context.Context, w *observer, progress bool, fn func(f catalogFile, read *atomic.Int64)) (total, sent int, err error) {
+	var bytes int64
+	if err := c.db.QueryRow(`SELECT COUNT(*), COALESCE(SUM(size), 0) FROM todo`).Scan(&total, &bytes); err != nil {
+		return 0, 0, err
+	}
+	jobs := make(chan catalogFile)
+	workers := runtime.NumCPU()
+	meter := newProgressMeter(progress, total, nil, workers)
+	meter.expectBytes(bytes)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range jobs {
+				fn(f, meter.begin(i, f.path))
+				meter.end(i)
+			}
+		}()
+	}
+	meter.run()
+	var last int64
+	for ctx.Err() == nil {
+		var page []catalogFile
+		err = w.read(func() error {
+			rows, err := c.db.Query(`SELECT rowid, path, COALESCE(hash, ''), size, mtime FROM todo WHERE rowid > ? ORDER BY rowid LIMIT ?`, last, catalogBatch)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var f catalogFile
+				if err := rows.Scan(&f.row, &f.path, &f.hash, &f.size, &f.mtime); err != nil {
+					return err
+				}
+				page = append(page, f)
+			}
+			return rows.Err()
+		})
+		if err != nil || len(page) == 0 {
+			break
+		}
+		last = page[len(page)-1].row
+	send:
+		for _, f := range page {
+			select {
+			case jobs <- f:
+				sent++
+			case <-ctx.Done():
+				break send
+			}
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	meter.finish()
+	return total, sent, err
+}
+
+// startRun records a new run and returns its id. A generate run resumes
+// the latest one for the same directory and algorithm if that never
+// finished; the files it already observed are skipped.
+func (c *catalog) startRun(mode, dir, algo string) (int64, error) {
+	if mode == "generate" {
+		var id int64
+		var finished sql.NullString
+		err := c.db.QueryRow(`SELECT id, finished FROM runs WHERE mode = ? AND dir = ? AND algo = ? ORDER BY id DESC LIMIT 1`,
+			mode, dir, algo).Scan(&id, &finished)
+		switch {
+		case err == sql.ErrNoRows:
+		case err != nil:
+			return 0, err
+		case !finished.Valid:
+			var done int
+			if err := c.db.QueryRow(`SELECT COUNT(*) FROM observations WHERE run_id = ?`, id).Scan(&done); err != nil {
+				return 0, err
+			}
+			fmt.Fprintf(os.Stderr, "Resuming run %d, %d files already done\n", id, done)
+			return id, nil
+		}
+	}
+	res, err := c.db.Exec(`INSERT INTO runs (mode, dir, algo, tool, started) VALUES (?, ?, ?, ?, ?)`,
+		mode, dir, algo, newListHeader(algo).buildLine(), time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// finishRun marks a run as complete.
+func (c *catalog) finishRun(run int64) error {
+	_, err := c.db.Exec(`UPDATE runs SET finished = ? WHERE id = ?`, time.Now().UTC().Format(time.RFC3339), run)
+	return err
+}
+
+// catalogObservation is what a run found for one file.
+type catalogObservation struct {
+	path   string
+	status string
+	hash   string
+	size   int64
+	mtime  int64
+	err    error
+}
+
+// observer records the observations of a run from the hashing workers,
+// committing them in batches.
+type observer struct {
+	c    *catalog
+	run  int64
+	mu   sync.Mutex
+	tx   *sql.Tx
+	n    int
+	err  error
+	file *sql.Stmt
+	obs  *sql.Stmt
+}
+
+func (c *catalog) observer(run int64) *observer {
+	return &observer{c: c, run: run}
+}
+
+// add records o. The first error sticks and is returned by flush.
+func (w *observer) add(o catalogObservation) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return
+	}
+	if w.tx == nil {
+		if w.err = w.begin(); w.err != nil {
+			return
+		}
+	}
+	if _, w.err = w.file.Exec(o.path); w.err != nil {
+		return
+	}
+	var hash, errText sql.NullString
+	if o.hash != "" {
+		hash = sql.NullString{String: o.hash, Valid: true}
+	}
+	if o.err != nil {
+		errText = sql.NullString{String: errorMessage(o.err), Valid: true}
+	}
+	if _, w.err = w.obs.Exec(w.run, o.path, o.status, hash, o.size, o.mtime, errText, time.Now().UTC().Format(time.RFC3339)); w.err != nil {
+		return
+	}
+	w.n++
+	if w.n%catalogBatch == 0 {
+		w.err = w.commit()
+	}
+}
+
+func (w *observer) begin() error {
+	tx, err := w.c.db.Begin()
+	if err != nil {
+		return err
+	}
+	w.tx = tx
+	if w.file, err = tx.Prepare(`INSERT OR IGNORE INTO files (path) VALUES (?)`); err == nil {
+		w.obs, err = tx.Prepare(`INSERT INTO observations (run_id, file_id, status, hash, size, mtime, error, observed)
+			VALUES (?, (SELECT id FROM files WHERE path = ?), ?, ?, ?, ?, ?, ?)`)
+	}
+	if err != nil {
+		tx.Rollback()
+		w.tx = nil
+	}
+	return err
+}
+
+func (w *observer) commit() error {
+	err := w.tx.Commit()
+	w.tx = nil
+	return err
+}
+
+// read runs fn, which queries the catalog, between two batches: the
+// catalog has a single connection, which the pending batch holds, so that
+// is committed first.
+func (w *observer) read(fn func() error) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.tx != nil {
+		w.err = w.commit()
+	}
+	if w.err != nil {
+		return w.err
+	}
+	return fn()
+}
+
+// flush commits what is pending and returns the first error met.
+func (w *observer) flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.tx != nil {
+		if err := w.commit(); w.err == nil {
+			w.err = err
+		}
+	}
+	return w.err
+}
+
+// generateCatalog hashes the regular files under dir into the catalog.
+// Files it already has a checksum for are skipped; with update, those whose
+// size or mtime has moved since are hashed again. An interrupted run is
+// resumed by running the same command again.
+func generateCatalog(ctx context.Context, dir string, update, progress bool, algo string, rep reporter) error {
+	c, err := openCatalog(catalogPath)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	run, err := c.startRun("generate", abs, algo)
+	if err != nil {
+		return err
+	}
+	if err := c.stage(ctx, abs, algo); err != nil {
+		return err
+	}
+
+	// Files the run observed before it was interrupted are done. Of the
+	// others, those without a checksum are hashed, and with update those
+	// changed since their checksum was made; these are STALE otherwise.
+	const pending = `
+		FROM walk w LEFT JOIN ref r ON r.path = w.path
+		WHERE w.path NOT IN (SELECT f.path FROM observations o JOIN files f ON f.id = o.file_id WHERE o.run_id = ?)`
+	const changed = `(r.size != w.size OR r.mtime != w.mtime)`
+	if _, err := c.db.Exec(`INSERT INTO todo (path, size, mtime) SELECT w.path, w.size, w.mtime`+pending+`
+		AND (r.path IS NULL OR (? AND `+changed+`)) ORDER BY w.rowid`, run, update); err != nil {
+		return err
+	}
+	var current, stale int
+	if err := c.db.QueryRow(`SELECT COUNT(*)`+pending+` AND r.path IS NOT NULL AND NOT `+changed, run).Scan(&current); err != nil {
+		return err
+	}
+	if !update {
+		rows, err := c.db.Query(`SELECT w.path`+pending+` AND r.path IS NOT NULL AND `+changed+` ORDER BY w.rowid`, run)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var p string
+			if err := rows.Scan(&p); err != nil {
+				rows.Close()
+				return err
+			}
+			stale++
+			fmt.Printf("%s STALE\n", p)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+
+	w := c.observer(run)
+	report := newGenerateReport(rep)
+	var failed atomic.Int64
+	total, sent, err := c.hashTodo(ctx, w, progress, func(f catalogFile, read *atomic.Int64) {
+		start := time.Now()
+		o := catalogObservation{path: f.path, status: "HASHED", size: f.size, mtime: f.mtime}
+		o.hash, o.err = hashWithRetry(ctx, f.path, algo, read)
+		// As with -xattr, the size and mtime must describe the file
+		// that was hashed.
+		if fi, err := os.Stat(f.path); o.err == nil && (err != nil || fi.Size() != f.size || fi.ModTime().UnixNano() != f.mtime) {
+			o.err = &fs.PathError{Op: "read", Path: f.path, Err: errUnstable}
+		}
+		if o.err != nil {
+			log.Printf("%v", o.err)
+			failed.Add(1)
+			o.status, o.hash = statusOf(o.err, "", "").String(), ""
+		}
+		w.add(o)
+		report.add(f.path, o.hash, o.err, start)
+	})
+	if ferr := w.flush(); ferr != nil && err == nil {
+		err = fmt.Errorf("%s: %w", catalogPath, ferr)
+	}
+	if err != nil {
+		return err
+	}
+	if sent < total {
+		fmt.Fprintf(os.Stderr, "Interrupted before every file was hashed; run the same command again to resume run %d\n", run)
+		return errInterrupted
+	}
+	if err := c.finishRun(run); err != nil {
+		return err
+	}
+	// After finishRun, so the report's history shows this run complete.
+	if err := report.close(total); err != nil {
+		return err
+	}
+	n := int(failed.Load())
+	fmt.Printf("Hashed:%d Current:%d Stale:%d Failed:%d\n", total-n, current, stale, n)
+	if stale > 0 {
+		fmt.Fprintln(os.Stderr, "Files changed since they were hashed; rerun with -update to hash them again")
+	}
+	if n > 0 {
+		return fmt.Errorf("%d files could not be hashed", n)
+	}
+	return nil
+}
+
+// catalogFiles returns the absolute paths of the catalog and of SQLite's
+// files next to it, which are left out when the catalog is kept under the
+// directory it describes.
+func catalogFiles() map[string]bool {
+	abs, _ := filepath.Abs(catalogPath)
+	return map[string]bool{abs: true, abs + "-wal": true, abs + "-shm": true, abs + "-journal": true}
+}
+
+// verifyCatalog checks the files under dir against their reference
+// checksums in the catalog and records the outcome as a verify run. Files
+// under dir without a checksum are NOT_IN_LIST. Results are reported as
+// files finish, as with a list.
+func verifyCatalog(ctx context.Context, dir string, show statusSet, progress bool, algo string, rep reporter) error {
+	col := newVerifyCollector(show, rep)
+	c, err := openCatalog(catalogPath)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	if err := c.stage(ctx, abs, algo); err != nil {
+		return err
+	}
+	if _, err := c.db.Exec(`INSERT INTO todo (path, hash, size, mtime) SELECT path, hash, size, mtime FROM ref ORDER BY path`); err != nil {
+		return err
+	}
+	var refs int
+	if err := c.db.QueryRow(`SELECT COUNT(*) FROM todo`).Scan(&refs); err != nil {
+		return err
+	}
+	if refs == 0 {
+		return fmt.Errorf("%s has no %s checksums for files under %s", catalogPath, algo, abs)
+	}
+	run, err := c.startRun("verify", abs, algo)
+	if err != nil {
+		return err
+	}
+
+	w := c.observer(run)
+	var mu sync.Mutex
+	total, sent, err := c.hashTodo(ctx, w, progress, func(f catalogFile, read *atomic.Int64) {
+		start := time.Now()
+		r := fileResult{path: f.path, expected: f.hash}
+		o := catalogObservation{path: f.path}
+		r.actual, r.err = hashWithRetry(ctx, f.path, algo, read)
+		r.status = statusOf(r.err, r.expected, r.actual)
+		if fi, err := os.Stat(f.path); err == nil {
+			r.size, o.size, o.mtime = fi.Size(), fi.Size(), fi.ModTime().UnixNano()
+			if r.status == statusMismatch {
+				r.status = classifyMismatch(f.size, f.mtime, fi)
+			}
+		}
+		r.duration = time.Since(start)
+		o.status, o.hash, o.err = r.status.String(), r.actual, r.err
+		w.add(o)
+		mu.Lock()
+		col.add(r)
+		mu.Unlock()
+	})
+	if ferr := w.flush(); ferr != nil && err == nil {
+		err = fmt.Errorf("%s: %w", catalogPath, ferr)
+	}
+	if err != nil {
+		return err
+	}
+	// An interrupted run stays unfinished.
+	if sent == total {
+		if err := c.finishRun(run); err != nil {
+			return err
+		}
+	}
+
+	if show[statusNotInList] {
+		rows, err := c.db.Query(`SELECT path, size FROM walk WHERE path NOT IN (SELECT path FROM ref) ORDER BY rowid`)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			r := fileResult{status: statusNotInList}
+			if err := rows.Scan(&r.path, &r.size); err != nil {
+				rows.Close()
+				return err
+			}
+			col.add(r)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+
+	col.summarize(total, "All files match")
+	err = col.close(total)
+	if sent < total && (err == nil || err == errCorrupted) {
+		fmt.Fprintf(os.Stderr, "Interrupted: verified %d of %d files, %d not checked\n", sent, total, total-sent)
+		return errInterrupted
+	}
+	return err
+}
+
+// runHistory implements the history subcommand, which answers questions
+// from a catalog: the runs it holds, or every observation of the given
+// files and when their hash last changed.
+func runHistory(args []string) int {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	db := fs.String("db", "", "catalog to read")
+	runs := fs.Bool("runs", false, "list the runs instead")
+	algo := fs.String("hash", "", "only observations with this algorithm")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s history -db CATALOG [-hash ALGO] FILE...\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "       %s history -db CATALOG -runs\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *db == "" || *runs == (fs.NArg() > 0) {
+		fs.Usage()
+		return 2
+	}
+	if _, err := os.Stat(*db); err != nil {
+		log.Print(err)
+		return 2
+	}
+	c, err := openCatalog(*db)
+	if err != nil {
+		log.Print(err)
+		return 2
+	}
+	defer c.close()
+	if *runs {
+		err = c.printRuns()
+	} else {
+		err = c.printHistory(fs.Args(), strings.ToLower(*algo))
+	}
+	if err != nil {
+		log.Print(err)
+		return 2
+	}
+	return 0
+}
+
+// catalogRun is a run with how many files it observed and how many of
+// those were not OK.
+type catalogRun struct {
+	ID                       int64
+	Mode, Algo, Dir, Started string
+	Finished                 string // empty if the run did not finish
+	Files, Failed            int64
+}
+
+// runs returns the runs over dir, or every run if dir is empty, oldest
+// first.
+func (c *catalog) runs(dir string) ([]catalogRun, error) {
+	rows, err := c.db.Query(`
+		SELECT r.id, r.mode, r.algo, r.dir, r.started, COALESCE(r.finished, ''),
+			COUNT(o.file_id), COALESCE(SUM(o.status NOT IN ('OK', 'HASHED')), 0)
+		FROM runs r LEFT JOIN observations o ON o.run_id = r.id
+		WHERE ? = '' OR r.dir = ?
+		GROUP BY r.id ORDER BY r.id`, dir, dir)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var runs []catalogRun
+	for rows.Next() {
+		var r catalogRun
+		if err := rows.Scan(&r.ID, &r.Mode, &r.Algo, &r.Dir, &r.Started, &r.Finished, &r.Files, &r.Failed); err != nil {
+			return nil, err
+		}
+		runs = append(runs, r)
+	}
+	return runs, rows.Err()
+}
+
+// printRuns lists every run.
+func (c *catalog) printRuns() error {
+	runs, err := c.runs("")
+	if err != nil {
+		return err
+	}
+	for _, r := range runs {
+		end := r.Finished
+		if end == "" {
+			end = "unfinished"
+		}
+		fmt.Printf("%d\t%s\t%s\t%s\t%s\t%s\tfiles=%d failed=%d\n", r.ID, r.Mode, r.Algo, r.Started, end, r.Dir, r.Files, r.Failed)
+	}
+	return nil
+}
+
+// printHistory prints every observation of each file in run order,
+// followed by when its hash last changed.
+func (c *catalog) printHistory(files []string, algo string) error {
+	for i, f := range files {
+		p, err := filepath.Abs(f)
+		if err != nil {
+			return err
+		}
+		rows, err := c.db.Query(`
+			SELECT o.run_id, r.mode, r.algo, o.status, COALESCE(o.hash, ''), o.observed
+			FROM observations o JOIN files f ON f.id = o.file_id JOIN runs r ON r.id = o.run_id
+			WHERE f.path = ? AND (? = '' OR r.algo = ?)
+			ORDER BY o.run_id`, p, algo, algo)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Println(p)
+		var n int
+		var changed string
+		last := map[string]string{} // latest hash by algorithm
+		for rows.Next() {
+			var run int64
+			var mode, a, status, hash, observed string
+			if err := rows.Scan(&run, &mode, &a, &status, &hash, &observed); err != nil {
+				rows.Close()
+				return err
+			}
+			n++
+			fmt.Printf("  %s  run %d  %-8s  %-10s  %s %s\n", observed, run, mode, status, a, hash)
+			if hash == "" {
+				continue
+			}
+			if prev, ok := last[a]; ok && prev != hash {
+				changed = fmt.Sprintf("%s (run %d, %s)", observed, run, a)
+			}
+			last[a] = hash
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		switch {
+		case n == 0:
+			fmt.Println("  no observations")
+		case changed == "":
+			fmt.Println("  hash never changed")
+		default:
+			fmt.Printf("  hash last changed %s\n", changed)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build cgo
+
+package main
+
+import _ "github.com/mattn/go-sqlite3"
+
+// catalogSupported reports whether the SQLite driver behind -db is part of
+// this build. The driver is C code and needs cgo.
+const catalogSupported = true
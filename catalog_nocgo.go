@@ -0,0 +1,7 @@
+//go:build !cgo
+
+package main
+
+// catalogSupported reports whether the SQLite driver behind -db is part of
+// this build. The driver is C code and needs cgo.
+const catalogSupported = false
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+)
+
+// compareResult is the outcome for one relative path of a tree comparison.
+type compareResult struct {
+	Path   string `json:"path"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Statuses of a tree comparison.
+const (
+	cmpSame      = "SAME"
+	cmpDifferent = "DIFFERENT"
+	cmpOnlyInA   = "ONLY_IN_A"
+	cmpOnlyInB   = "ONLY_IN_B"
+	cmpError     = "ERROR"
+)
+
+var compareStatuses = []string{cmpSame, cmpDifferent, cmpOnlyInA, cmpOnlyInB, cmpError}
+
+// runCompare implements the compare subcommand and returns the exit status:
+// 0 if the trees match, 1 if they differ and 2 on error.
+func runCompare(args []string) int {
+	fs := flag.NewFlagSet("compare", flag.ExitOnError)
+	dirA := fs.String("a", "", "first directory")
+	dirB := fs.String("b", "", "second directory")
+	algo := fs.String("hash", "sha1", "hash algorithm used to compare file contents")
+	quick := fs.Bool("quick", false, "treat files with equal size and modification time as identical without hashing them")
+	verbose := fs.Bool("verbose", false, "also print identical files")
+	jsonOut := fs.Bool("json", false, "print the results as JSON lines")
+	progress := fs.Bool("progress", false, "show progress updates")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s compare -a DIR1 -b DIR2 [-hash sha1] [-quick]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *dirA == "" || *dirB == "" || fs.NArg() != 0 {
+		fs.Usage()
+		return 2
+	}
+
+	counts, err := compareTrees(signalContext(), *dirA, *dirB, *algo, *quick, *verbose, *jsonOut, *progress, os.Stdout)
+	if err == errInterrupted {
+		return 130
+	}
+	if err != nil {
+		log.Print(err)
+		return 2
+	}
+	if counts[cmpError] > 0 {
+		return 2
+	}
+	if counts[cmpDifferent]+counts[cmpOnlyInA]+counts[cmpOnlyInB] > 0 {
+		return 1
+	}
+	return 0
+}
+
+// walkTree returns the regular files under root keyed by slash-separated
+// relative path.
+func walkTree(ctx context.Context, root string) (map[string]os.FileInfo, error) {
+	files := map[string]os.FileInfo{}
+	err := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return errInterrupted
+		}
+		if d.IsDir() {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = fi
+		return nil
+	})
+	return files, err
+}
+
+// compareTrees compares the regular files of dirA and dirB by relative
+// path, hashing the pairs of equal size on the worker pool, and writes the
+// differences to w. It returns the number of paths with each status.
+func compareTrees(ctx context.Context, dirA, dirB, algo string, quick, verbose, jsonOut, progress bool, w io.Writer) (map[string]int, error) {
+	var filesA, filesB map[string]os.FileInfo
+	var errA, errB error
+	var walk sync.WaitGroup
+	walk.Add(2)
+	go func() {
+		defer walk.Done()
+		filesA, errA = walkTree(ctx, dirA)
+	}()
+	go func() {
+		defer walk.Done()
+		filesB, errB = walkTree(ctx, dirB)
+	}()
+	walk.Wait()
+	for _, err := range []error{errA, errB} {
+		if err == errInterrupted {
+			fmt.Fprintln(os.Stderr, "Interrupted while scanning, nothing compared")
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	counts := map[string]int{}
+	var mu sync.Mutex
+	emit := func(r compareResult) {
+		mu.Lock()
+		defer mu.Unlock()
+		counts[r.Status]++
+		if r.Status == cmpSame && !verbose {
+			return
+		}
+		if jsonOut {
+			b, _ := json.Marshal(r)
+			fmt.Fprintf(w, "%s\n", b)
+		} else if r.Error != "" {
+			fmt.Fprintf(w, "%s %s (%s)\n", r.Status, r.Path, r.Error)
+		} else {
+			fmt.Fprintf(w, "%s %s\n", r.Status, r.Path)
+		}
+	}
+
+	// Pre-pass: only pairs that may be identical need hashing.
+	var toHash []string
+	sizes := map[string]int64{}
+	for _, rel := range sortedKeys(filesA) {
+		a := filesA[rel]
+		b, ok := filesB[rel]
+		switch {
+		case !ok:
+			emit(compareResult{Path: rel, Status: cmpOnlyInA})
+		case a.Size() != b.Size():
+			emit(compareResult{Path: rel, Status: cmpDifferent})
+		case quick && a.ModTime().Equal(b.ModTime()):
+			emit(compareResult{Path: rel, Status: cmpSame})
+		default:
+			toHash = append(toHash, rel)
+			sizes[filepath.Join(dirA, rel)] = a.Size()
+			sizes[filepath.Join(dirB, rel)] = b.Size()
+		}
+	}
+	for _, rel := range sortedKeys(filesB) {
+		if _, ok := filesA[rel]; !ok {
+			emit(compareResult{Path: rel, Status: cmpOnlyInB})
+		}
+	}
+
+	// Each worker hashes both sides of a pair at once, as the two trees
+	// usually live on different storage.
+	jobs := make(chan string)
+	workers := runtime.NumCPU()
+	meter := newProgressMeter(progress, 2*len(toHash), sizes, 2*workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for rel := range jobs {
+				pa, pb := filepath.Join(dirA, rel), filepath.Join(dirB, rel)
+				var hb string
+				var errB error
+				done := make(chan struct{})
+				go func() {
+					defer close(done)
+					hb, errB = hashWithRetry(ctx, pb, algo, meter.begin(2*i+1, pb))
+					meter.end(2*i + 1)
+				}()
+				ha, err := hashWithRetry(ctx, pa, algo, meter.begin(2*i, pa))
+				meter.end(2 * i)
+				<-done
+				if err == nil {
+					err = errB
+				}
+				r := compareResult{Path: rel, Status: cmpSame}
+				if err != nil {
+					r.Status, r.Error = cmpError, errorMessage(err)
+				} else if ha != hb {
+					r.Status = cmpDifferent
+				}
+				emit(r)
+			}
+		}()
+	}
+	meter.run()
+	sent := dispatch(ctx, jobs, toHash)
+	close(jobs)
+	wg.Wait()
+	meter.finish()
+
+	total := 0
+	for _, n := range counts {
+		total += n
+	}
+	if jsonOut {
+		b, _ := json.Marshal(map[string]any{"summary": counts, "total": total})
+		fmt.Fprintf(w, "%s\n", b)
+	} else {
+		fmt.Fprintf(w, "Total:%d", total)
+		for _, s := range compareStatuses {
+			fmt.Fprintf(w, " %s:%d", s, counts[s])
+		}
+		fmt.Fprintln(w)
+	}
+	if sent < len(toHash) {
+		fmt.Fprintf(os.Stderr, "Interrupted: compared %d of %d pairs needing a hash, %d not checked\n", sent, len(toHash), len(toHash)-sent)
+		return counts, errInterrupted
+	}
+	return counts, nil
+}
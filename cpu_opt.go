@@ -1,15 +1,63 @@
 package main
 
 import (
+	"fmt"
 	"runtime"
+	"slices"
+	"strings"
 
+	"CheckSumFolder/blake3c"
+	"CheckSumFolder/rapidhashc"
+	"CheckSumFolder/t1ha"
+	"CheckSumFolder/wyhashc"
 	cpuid "github.com/klauspost/cpuid/v2"
 )
 
-var useStdSHA256 bool
-var useBlake3C bool
-var useWyhashC bool
-var useRapidhashC bool
+// impl holds the implementation selected for each algorithm: "go" for
+// pure Go (possibly with Go assembly), "c" for the bundled C code via cgo and
+// "simd" for the third-party SIMD packages. It is filled from cpuid at
+// startup and may be overridden with -impl or CHECKSUMFOLDER_IMPL.
+var impl = map[string]string{}
+
+// implChoices lists the implementations each algorithm can switch between.
+// Only implementations that produce identical digests are offered side by
+// side. The Go fallbacks for t1ha2, wyhash and rapidhash implement other
+// revisions of those algorithms than the bundled C code, so they are only
+// used in builds without the C code and lists record which one was used.
+var implChoices = map[string][]string{
+	"md5":        {"go"},
+	"sha1":       {"go"},
+	"sha256":     {"go", "simd"},
+	"sha512":     {"go"},
+	"blake2b":    {"simd"},
+	"blake3":     {"go", "c"},
+	"xxhash":     {"go"},
+	"xxh3":       {"simd"},
+	"xxh128":     {"simd"},
+	"t1ha1":      {"go", "c"},
+	"t1ha2":      {"c"},
+	"highway64":  {"simd"},
+	"highway128": {"simd"},
+	"highway256": {"simd"},
+	"wyhash":     {"c"},
+	"rapidhash":  {"c"},
+}
+
+// compiledBackend reports which of "c" or "go" was compiled into the
+// package backing algo. Algorithms without a C variant report "go".
+func compiledBackend(algo string) string {
+	switch algo {
+	case "blake3":
+		return blake3c.Backend
+	case "t1ha1", "t1ha2":
+		return t1ha.Backend
+	case "wyhash":
+		return wyhashc.Backend
+	case "rapidhash":
+		return rapidhashc.Backend
+	}
+	return "go"
+}
 
 func init() {
 	// On ARM systems some features require explicit detection.
@@ -20,27 +68,183 @@ func init() {
 		cpuid.DetectARM()
 	}
 
+	for algo, choices := range implChoices {
+		impl[algo] = choices[len(choices)-1]
+	}
+	impl["blake3"] = "go"
+	generic := func() {
+		impl["sha256"] = "go"
+	}
+
 	// Fallback to the standard crypto/sha256 if we lack SIMD features
 	switch runtime.GOARCH {
 	case "amd64", "386":
-		if cpuid.CPU.Supports(cpuid.SSE2) {
-			useWyhashC = true
-			useRapidhashC = true
-		} else {
-			useStdSHA256 = true
+		if !cpuid.CPU.Supports(cpuid.SSE2) {
+			generic()
+		}
+		// The BLAKE3 C code dispatches between its SSE4.1, AVX2 and
+		// AVX-512 kernels itself.
+		if runtime.GOARCH == "amd64" && cpuid.CPU.Supports(cpuid.SSE4) {
+			impl["blake3"] = "c"
 		}
 	case "arm64":
 		if cpuid.CPU.Supports(cpuid.ASIMD) {
-			useBlake3C = true
-			useWyhashC = true
-			useRapidhashC = true
+			impl["blake3"] = "c"
 		} else {
-			useStdSHA256 = true
+			generic()
 		}
-	case "arm":
-		useStdSHA256 = true
 	default:
-		// Unknown architecture, use conservative default
-		useStdSHA256 = true
+		// 32-bit ARM and unknown architectures use conservative defaults
+		generic()
+	}
+
+	// C code that was not compiled into this build cannot be selected.
+	for algo, choice := range impl {
+		if choice == "c" && compiledBackend(algo) != "c" {
+			impl[algo] = "go"
+		}
+	}
+}
+
+// digestsDiffer lists the algorithms whose Go fallback computes different
+// digests than the C implementation.
+var digestsDiffer = map[string]bool{
+	"t1ha2":     true,
+	"wyhash":    true,
+	"rapidhash": true,
+}
+
+// checkBackend refuses a list whose header records an implementation of
+// its algorithm that computes different digests than the one selected now.
+func checkBackend(h listHeader) error {
+	return checkDigestBackend("list was generated", h.Hash, h.Backend)
+}
+
+// checkDigestBackend refuses digests of algo that were made, as what says,
+// with the recorded backend if this build computes them differently.
+// Digests that record no backend are accepted.
+func checkDigestBackend(what, algo, backend string) error {
+	if !digestsDiffer[algo] || backend == "" {
+		return nil
+	}
+	recorded, _, _ := strings.Cut(backend, " ")
+	current, _, _ := strings.Cut(backendOf(algo), " ")
+	if recorded != current {
+		return fmt.Errorf("%s with the %s implementation of %s, which computes different digests than the %s implementation in this build", what, recorded, algo, current)
+	}
+	return nil
+}
+
+// applyImplOverrides parses a comma separated list of algo=impl pairs and
+// replaces the automatically selected implementations.
+func applyImplOverrides(spec string) error {
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		algo, choice, ok := strings.Cut(pair, "=")
+		if !ok {
+			return fmt.Errorf("invalid implementation override %q, want algo=go|c|simd", pair)
+		}
+		algo = strings.ToLower(strings.TrimSpace(algo))
+		choice = strings.ToLower(strings.TrimSpace(choice))
+		choices, known := implChoices[algo]
+		if !known {
+			return fmt.Errorf("unknown hash algorithm: %s", algo)
+		}
+		if !slices.Contains(choices, choice) {
+			return fmt.Errorf("%s has no %q implementation (available: %s)", algo, choice, strings.Join(choices, ", "))
+		}
+		if choice == "c" && compiledBackend(algo) != "c" {
+			return fmt.Errorf("%s: C implementation not compiled into this build (requires cgo on amd64 or arm64)", algo)
+		}
+		impl[algo] = choice
+	}
+	return nil
+}
+
+// algorithms lists every value accepted by -hash in display order.
+var algorithms = []string{
+	"md5", "sha1", "sha256", "sha512", "blake2b", "blake3", "xxhash", "xxh3", "xxh128",
+	"t1ha1", "t1ha2", "highway64", "highway128", "highway256", "wyhash", "rapidhash",
+}
+
+// simdLevel returns the first feature name from the candidates the CPU
+// supports, or "generic" when none is available.
+func simdLevel(candidates ...cpuid.FeatureID) string {
+	for _, id := range candidates {
+		if cpuid.CPU.Supports(id) {
+			return strings.ToLower(id.String())
+		}
+	}
+	return "generic"
+}
+
+// backendOf describes the implementation selected for algo on this machine.
+func backendOf(algo string) string {
+	amd64 := runtime.GOARCH == "amd64"
+	arm64 := runtime.GOARCH == "arm64"
+	algo = strings.ToLower(algo)
+	switch algo {
+	case "md5", "sha1", "sha512":
+		return "go (crypto/" + algo + ")"
+	case "sha256":
+		if impl["sha256"] == "go" {
+			return "go (crypto/sha256)"
+		}
+		switch {
+		case amd64 && cpuid.CPU.Supports(cpuid.SHA, cpuid.SSSE3, cpuid.SSE4):
+			return "simd (sha256-simd, sha-ni)"
+		case arm64 && cpuid.CPU.Supports(cpuid.SHA2):
+			return "simd (sha256-simd, sha2)"
+		}
+		return "simd (sha256-simd, crypto/sha256 fallback)"
+	case "blake2b":
+		if amd64 || runtime.GOARCH == "386" {
+			return "simd (blake2b-simd, " + simdLevel(cpuid.AVX2, cpuid.AVX, cpuid.SSSE3) + ")"
+		}
+		return "go (blake2b-simd, generic)"
+	case "blake3":
+		if impl["blake3"] == "c" {
+			if amd64 {
+				if cpuid.CPU.Supports(cpuid.AVX512F, cpuid.AVX512VL) {
+					return "c (blake3c, avx512)"
+				}
+				return "c (blake3c, " + simdLevel(cpuid.AVX2, cpuid.SSE4) + ")"
+			}
+			return "c (blake3c, " + simdLevel(cpuid.ASIMD) + ")"
+		}
+		if amd64 {
+			return "go (zeebo/blake3, " + simdLevel(cpuid.AVX2, cpuid.SSE4) + ")"
+		}
+		return "go (zeebo/blake3, generic)"
+	case "xxhash":
+		if amd64 || arm64 {
+			return "asm (cespare/xxhash)"
+		}
+		return "go (cespare/xxhash)"
+	case "xxh3", "xxh128":
+		if amd64 {
+			return "simd (zeebo/xxh3, " + simdLevel(cpuid.AVX512F, cpuid.AVX2, cpuid.SSE2) + ")"
+		}
+		return "go (zeebo/xxh3, generic)"
+	case "t1ha1", "t1ha2":
+		return impl[algo] + " (t1ha)"
+	case "highway64", "highway128", "highway256":
+		switch {
+		case amd64:
+			return "simd (highwayhash, " + simdLevel(cpuid.AVX2, cpuid.SSE4) + ")"
+		case arm64:
+			return "simd (highwayhash, " + simdLevel(cpuid.SVE, cpuid.ASIMD) + ")"
+		case runtime.GOARCH == "ppc64le":
+			return "simd (highwayhash, vsx)"
+		}
+		return "go (highwayhash, generic)"
+	case "wyhash":
+		return impl["wyhash"] + " (wyhash)"
+	case "rapidhash":
+		return impl["rapidhash"] + " (rapidhash)"
 	}
+	return "unknown"
 }
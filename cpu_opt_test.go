@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestCheckBackend(t *testing.T) {
+	other := "go (wyhash)"
+	if impl["wyhash"] == "go" {
+		other = "c (wyhash)"
+	}
+	if err := checkBackend(listHeader{Hash: "wyhash", Backend: backendOf("wyhash")}); err != nil {
+		t.Errorf("same backend: %v", err)
+	}
+	if err := checkBackend(listHeader{Hash: "wyhash", Backend: other}); err == nil {
+		t.Errorf("list made with %s accepted by %s", other, backendOf("wyhash"))
+	}
+	// blake3 gives the same digests with either implementation.
+	if err := checkBackend(listHeader{Hash: "blake3", Backend: "go (zeebo/blake3, generic)"}); err != nil {
+		t.Errorf("blake3: %v", err)
+	}
+	// Lists without a header record no backend.
+	if err := checkBackend(listHeader{Hash: "rapidhash"}); err != nil {
+		t.Errorf("no backend: %v", err)
+	}
+}
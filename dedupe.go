@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// journalEntry records one file replaced by dedupe, with what is needed to
+// give it back its own copy of the data.
+type journalEntry struct {
+	Time   string      `json:"time"`
+	Mode   string      `json:"mode"`
+	Path   string      `json:"path"`
+	Target string      `json:"target"`
+	Hash   string      `json:"hash"`
+	Size   int64       `json:"size"`
+	Perm   os.FileMode `json:"perm"`
+	MTime  time.Time   `json:"mtime"`
+	UID    *int        `json:"uid,omitempty"`
+	GID    *int        `json:"gid,omitempty"`
+}
+
+// runDedupe implements the dedupe subcommand and returns the exit status:
+// 0 on success and 2 if any file could not be processed.
+func runDedupe(args []string) int {
+	fs := flag.NewFlagSet("dedupe", flag.ExitOnError)
+	dir := fs.String("dir", "", "directory to deduplicate")
+	list := fs.String("list", "", "take duplicate candidates from an existing checksum list")
+	algo := fs.String("hash", "sha1", "hash algorithm for finding duplicates")
+	mode := fs.String("mode", "hardlink", "replace duplicates with a hardlink or a reflink")
+	minSize := fs.Int64("min-size", 1, "ignore files smaller than this many bytes")
+	dryRun := fs.Bool("dry-run", false, "only print what would be done")
+	journal := fs.String("journal", "dedupe-journal.jsonl", "append every change to this file")
+	undo := fs.String("undo", "", "give every file recorded in this journal its own copy again")
+	progress := fs.Bool("progress", false, "show progress updates")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s dedupe -dir DIR | -list FILE [-mode hardlink|reflink] [-dry-run] [-journal FILE]\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "       %s dedupe -undo JOURNAL\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *undo != "" {
+		if err := undoDedupe(*undo, *dryRun); err != nil {
+			log.Print(err)
+			return 2
+		}
+		return 0
+	}
+	if (*dir == "") == (*list == "") || fs.NArg() != 0 || (*mode != "hardlink" && *mode != "reflink") {
+		fs.Usage()
+		return 2
+	}
+
+	var sets []dupeSet
+	var err error
+	if *list != "" {
+		sets, err = dupesFromList(*list, *minSize)
+	} else {
+		sets, err = findDupes(signalContext(), *dir, *algo, *minSize, *progress)
+	}
+	if err == errInterrupted {
+		return 130
+	}
+	if err != nil {
+		log.Print(err)
+		return 2
+	}
+
+	var jw *bufio.Writer
+	var jf *os.File
+	if !*dryRun {
+		if jf, err = os.OpenFile(*journal, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+			log.Print(err)
+			return 2
+		}
+		defer jf.Close()
+		jw = bufio.NewWriter(jf)
+	}
+
+	var linked, failed int
+	var reclaimed int64
+	for _, s := range sets {
+		if s.Size < 0 {
+			continue
+		}
+		keep := s.Files[0]
+		for _, p := range s.Files[1:] {
+			e, err := dedupeFile(keep, p, *mode, *dryRun, func(e *journalEntry) error {
+				e.Hash = s.Hash
+				b, _ := json.Marshal(e)
+				jw.Write(append(b, '\n'))
+				if err := jw.Flush(); err != nil {
+					return err
+				}
+				return jf.Sync()
+			})
+			if err != nil {
+				log.Printf("%s: %v", p, err)
+				failed++
+				continue
+			}
+			if e == nil {
+				continue
+			}
+			linked++
+			reclaimed += e.Size
+			verb := "linked"
+			if *dryRun {
+				verb = "would link"
+			}
+			fmt.Printf("%s %s (%s) -> %s\n", verb, p, *mode, keep)
+		}
+	}
+	if *dryRun {
+		fmt.Printf("Would replace %d files, reclaiming %s\n", linked, formatBytes(reclaimed))
+	} else {
+		fmt.Printf("Replaced %d files, reclaimed %s; journal: %s\n", linked, formatBytes(reclaimed), *journal)
+	}
+	if failed > 0 {
+		return 2
+	}
+	return 0
+}
+
+// dedupeFile replaces path with a hard link to, or reflink of, keep after
+// checking byte for byte that both are identical. record is called with the
+// journal entry before path is replaced. It returns nil when path already
+// is keep.
+func dedupeFile(keep, path, mode string, dryRun bool, record func(*journalEntry) error) (*journalEntry, error) {
+	fk, err := os.Stat(keep)
+	if err != nil {
+		return nil, err
+	}
+	fp, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !fp.Mode().IsRegular() {
+		return nil, errors.New("not a regular file")
+	}
+	if os.SameFile(fk, fp) {
+		return nil, nil
+	}
+	if same, err := sameContents(keep, path); err != nil {
+		return nil, err
+	} else if !same {
+		return nil, fmt.Errorf("contents differ from %s, left alone", keep)
+	}
+	e := &journalEntry{
+		Time:   time.Now().UTC().Format(time.RFC3339),
+		Mode:   mode,
+		Path:   path,
+		Target: keep,
+		Size:   fp.Size(),
+		Perm:   fp.Mode().Perm(),
+		MTime:  fp.ModTime(),
+	}
+	if uid, gid, ok := fileOwner(fp); ok {
+		e.UID, e.GID = &uid, &gid
+	}
+	if dryRun {
+		return e, nil
+	}
+
+	tmp := filepath.Join(filepath.Dir(path), fmt.Sprintf(".%s.%d.dedupe", filepath.Base(path), time.Now().UnixNano()))
+	if mode == "hardlink" {
+		err = os.Link(keep, tmp)
+	} else {
+		err = reflinkTo(keep, tmp, e)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	// path may have changed while it was compared.
+	if now, err := os.Lstat(path); err != nil || !unchanged(fp, now) {
+		os.Remove(tmp)
+		return nil, errUnstable
+	}
+	if err := record(e); err != nil {
+		os.Remove(tmp)
+		return nil, fmt.Errorf("writing journal: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	return e, nil
+}
+
+// reflinkTo creates tmp as a reflink of keep with the metadata in e.
+func reflinkTo(keep, tmp string, e *journalEntry) error {
+	src, err := os.Open(keep)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(tmp, os.O_CREATE|os.O_EXCL|os.O_WRONLY, e.Perm)
+	if err != nil {
+		return err
+	}
+	if err := reflink(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	return restoreMetadata(tmp, e)
+}
+
+// restoreMetadata applies the permissions, modification time and, where
+// possible, the owner recorded in e to path.
+func restoreMetadata(path string, e *journalEntry) error {
+	if err := os.Chmod(path, e.Perm); err != nil {
+		return err
+	}
+	if err := os.Chtimes(path, e.MTime, e.MTime); err != nil {
+		return err
+	}
+	if e.UID != nil && e.GID != nil {
+		// Only root may give files away; keep going otherwise.
+		os.Lchown(path, *e.UID, *e.GID)
+	}
+	return nil
+}
+
+// sameContents compares two files byte for byte.
+func sameContents(a, b string) (bool, error) {
+	fa, err := os.Open(a)
+	if err != nil {
+		return false, err
+	}
+	defer fa.Close()
+	fb, err := os.Open(b)
+	if err != nil {
+		return false, err
+	}
+	defer fb.Close()
+	ba := make([]byte, 1<<20)
+	bb := make([]byte, 1<<20)
+	for {
+		na, errA := io.ReadFull(fa, ba)
+		nb, errB := io.ReadFull(fb, bb)
+		if na != nb || !bytes.Equal(ba[:na], bb[:nb]) {
+			return false, nil
+		}
+		if errA == io.EOF || errA == io.ErrUnexpectedEOF {
+			return errB == io.EOF || errB == io.ErrUnexpectedEOF, nil
+		}
+		if errA != nil {
+			return false, errA
+		}
+		if errB != nil {
+			return false, errB
+		}
+	}
+}
+
+// undoDedupe walks a journal backwards and gives each recorded file an
+// independent copy of its data with its original metadata.
+func undoDedupe(journal string, dryRun bool) error {
+	f, err := os.Open(journal)
+	if err != nil {
+		return err
+	}
+	var entries []journalEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			f.Close()
+			return fmt.Errorf("%s: %w", journal, err)
+		}
+		entries = append(entries, e)
+	}
+	f.Close()
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	var restored, failed int
+	for _, e := range slices.Backward(entries) {
+		if e.Mode == "hardlink" {
+			fp, errP := os.Stat(e.Path)
+			ft, errT := os.Stat(e.Target)
+			if errP == nil && errT == nil && !os.SameFile(fp, ft) {
+				continue // already independent
+			}
+		}
+		if dryRun {
+			fmt.Printf("would restore %s\n", e.Path)
+			restored++
+			continue
+		}
+		if err := unshare(&e); err != nil {
+			log.Printf("%s: %v", e.Path, err)
+			failed++
+			continue
+		}
+		fmt.Printf("restored %s\n", e.Path)
+		restored++
+	}
+	fmt.Printf("Restored %d files\n", restored)
+	if failed > 0 {
+		return fmt.Errorf("%d files could not be restored", failed)
+	}
+	return nil
+}
+
+// unshare replaces e.Path with a private copy of its current contents.
+func unshare(e *journalEntry) error {
+	src, err := os.Open(e.Path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmp := filepath.Join(filepath.Dir(e.Path), fmt.Sprintf(".%s.%d.undo", filepath.Base(e.Path), time.Now().UnixNano()))
+	dst, err := os.OpenFile(tmp, os.O_CREATE|os.O_EXCL|os.O_WRONLY, e.Perm)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if err == nil {
+		err = dst.Sync()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = restoreMetadata(tmp, e)
+	}
+	if err == nil {
+		err = os.Rename(tmp, e.Path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"github.com/zeebo/xxh3"
+)
+
+// dupeSet is a group of files with identical contents.
+type dupeSet struct {
+	Hash  string   `json:"hash"`
+	Size  int64    `json:"size"`
+	Files []string `json:"files"`
+	// Wasted is the space the copies take beyond the first. Files that are
+	// already hard links of each other are not counted.
+	Wasted int64 `json:"wasted"`
+}
+
+// partialChunk is how much of the start and of the end of a file the
+// partial hash reads.
+const partialChunk = 16 << 10
+
+// runDupes implements the dupes subcommand and returns the exit status: 0
+// if no duplicates were found, 1 if some were and 2 on error.
+func runDupes(args []string) int {
+	fs := flag.NewFlagSet("dupes", flag.ExitOnError)
+	dir := fs.String("dir", "", "directory to search")
+	list := fs.String("list", "", "find duplicates in an existing checksum list instead of hashing")
+	algo := fs.String("hash", "sha1", "hash algorithm for the full comparison")
+	minSize := fs.Int64("min-size", 1, "ignore files smaller than this many bytes")
+	jsonOut := fs.Bool("json", false, "print one JSON object per duplicate set")
+	progress := fs.Bool("progress", false, "show progress updates")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s dupes -dir DIR [-hash sha1] | -list FILE\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if (*dir == "") == (*list == "") || fs.NArg() != 0 {
+		fs.Usage()
+		return 2
+	}
+
+	var sets []dupeSet
+	var err error
+	if *list != "" {
+		sets, err = dupesFromList(*list, *minSize)
+	} else {
+		sets, err = findDupes(signalContext(), *dir, *algo, *minSize, *progress)
+	}
+	if err == errInterrupted {
+		return 130
+	}
+	if err != nil {
+		log.Print(err)
+		return 2
+	}
+	writeDupes(os.Stdout, sets, *jsonOut)
+	if len(sets) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// findDupes finds identical regular files under dir. Files are grouped by
+// size first, then by a hash of their first and last 16 KiB, and only the
+// remaining candidates are hashed in full with algo.
+func findDupes(ctx context.Context, dir, algo string, minSize int64, progress bool) ([]dupeSet, error) {
+	bySize := map[int64][]string{}
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return errInterrupted
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if fi.Size() >= minSize {
+			bySize[fi.Size()] = append(bySize[fi.Size()], path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Partial hashes only pay off for files larger than what they read.
+	var partial []string
+	var groups [][]string
+	for size, paths := range bySize {
+		switch {
+		case len(paths) < 2:
+		case size > 2*partialChunk:
+			partial = append(partial, paths...)
+		default:
+			groups = append(groups, paths)
+		}
+	}
+	sums, err := hashAll(ctx, partial, func(path string, _ *atomic.Int64) (string, error) {
+		return partialHash(path)
+	}, false)
+	if err != nil {
+		return nil, err
+	}
+	groups = append(groups, regroup(partial, sums, bySize)...)
+
+	var full []string
+	for _, g := range groups {
+		full = append(full, g...)
+	}
+	sums, err = hashAll(ctx, full, func(path string, read *atomic.Int64) (string, error) {
+		return hashWithRetry(ctx, path, algo, read)
+	}, progress)
+	if err != nil {
+		return nil, err
+	}
+
+	var sets []dupeSet
+	for _, g := range groups {
+		byHash := map[string][]string{}
+		for _, p := range g {
+			if h, ok := sums[p]; ok {
+				byHash[h] = append(byHash[h], p)
+			}
+		}
+		for h, files := range byHash {
+			if len(files) > 1 {
+				sets = append(sets, newDupeSet(h, files))
+			}
+		}
+	}
+	sortDupes(sets)
+	return sets, nil
+}
+
+// regroup splits paths into groups of equal size and equal partial hash.
+func regroup(paths []string, sums map[string]string, bySize map[int64][]string) [][]string {
+	size := map[string]int64{}
+	for s, ps := range bySize {
+		for _, p := range ps {
+			size[p] = s
+		}
+	}
+	type key struct {
+		size int64
+		sum  string
+	}
+	m := map[key][]string{}
+	for _, p := range paths {
+		if s, ok := sums[p]; ok {
+			k := key{size[p], s}
+			m[k] = append(m[k], p)
+		}
+	}
+	var groups [][]string
+	for _, g := range m {
+		if len(g) > 1 {
+			groups = append(groups, g)
+		}
+	}
+	return groups
+}
+
+// partialHash hashes the first and last partialChunk bytes of a file.
+func partialHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, 2*partialChunk)
+	if _, err := io.ReadFull(f, buf[:partialChunk]); err != nil {
+		return "", err
+	}
+	if _, err := f.ReadAt(buf[partialChunk:], fi.Size()-partialChunk); err != nil {
+		return "", err
+	}
+	sum := xxh3.Hash128(buf).Bytes()
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// hashAll runs fn over paths on the worker pool, passing it the worker's
+// counter of bytes read for -progress. Files that fail are logged and left
+// out of the result.
+func hashAll[T any](ctx context.Context, paths []string, fn func(string, *atomic.Int64) (T, error), progress bool) (map[string]T, error) {
+	sums := make(map[string]T, len(paths))
+	var sizes map[string]int64
+	if progress {
+		sizes = make(map[string]int64, len(paths))
+		for _, p := range paths {
+			if fi, err := os.Stat(p); err == nil {
+				sizes[p] = fi.Size()
+			}
+		}
+	}
+	var mu sync.Mutex
+	jobs := make(chan string)
+	workers := runtime.NumCPU()
+	meter := newProgressMeter(progress, len(paths), sizes, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range jobs {
+				read := meter.begin(i, p)
+				sum, err := fn(p, read)
+				meter.end(i)
+				if err != nil {
+					log.Printf("%v", err)
+					continue
+				}
+				mu.Lock()
+				sums[p] = sum
+				mu.Unlock()
+			}
+		}()
+	}
+	meter.run()
+	sent := dispatch(ctx, jobs, paths)
+	close(jobs)
+	wg.Wait()
+	meter.finish()
+	if sent < len(paths) {
+		fmt.Fprintln(os.Stderr, "Interrupted before every file was hashed, nothing reported")
+		return nil, errInterrupted
+	}
+	return sums, nil
+}
+
+// dupesFromList groups the entries of a checksum list, or the strongest
+// column of a hashdeep file, by hash. Sizes, and with them the wasted
+// space, are only known for files that exist here.
+func dupesFromList(listfile string, minSize int64) ([]dupeSet, error) {
+	var entries []listEntry
+	if isHashdeepList(listfile) {
+		var err error
+		if entries, err = hashdeepListEntries(listfile, ""); err != nil {
+			return nil, err
+		}
+	} else {
+		jsonIn, err := isJSONList(listfile)
+		if err != nil {
+			return nil, err
+		}
+		if entries, err = readList(listfile, jsonIn); err != nil {
+			return nil, err
+		}
+	}
+	byHash := map[string][]string{}
+	for _, e := range entries {
+		if !slices.Contains(byHash[e.hash], e.path) {
+			byHash[e.hash] = append(byHash[e.hash], e.path)
+		}
+	}
+	var sets []dupeSet
+	for h, files := range byHash {
+		if len(files) < 2 {
+			continue
+		}
+		s := newDupeSet(h, files)
+		if s.Size >= 0 && s.Size < minSize {
+			continue
+		}
+		sets = append(sets, s)
+	}
+	sortDupes(sets)
+	return sets, nil
+}
+
+// newDupeSet builds the set for files sharing hash. Size is -1 if none of
+// the files can be found.
+func newDupeSet(hash string, files []string) dupeSet {
+	slices.Sort(files)
+	s := dupeSet{Hash: hash, Size: -1, Files: files}
+	var seen []os.FileInfo
+	for _, p := range files {
+		fi, err := os.Stat(p)
+		if err != nil {
+			continue
+		}
+		s.Size = fi.Size()
+		if !slices.ContainsFunc(seen, func(o os.FileInfo) bool { return os.SameFile(o, fi) }) {
+			seen = append(seen, fi)
+		}
+	}
+	if len(seen) > 1 {
+		s.Wasted = s.Size * int64(len(seen)-1)
+	}
+	return s
+}
+
+// sortDupes orders sets by wasted space, largest first.
+func sortDupes(sets []dupeSet) {
+	slices.SortFunc(sets, func(a, b dupeSet) int {
+		if a.Wasted != b.Wasted {
+			if a.Wasted > b.Wasted {
+				return -1
+			}
+			return 1
+		}
+		return slices.Compare(a.Files, b.Files)
+	})
+}
+
+func writeDupes(w io.Writer, sets []dupeSet, jsonOut bool) {
+	var files int
+	var wasted int64
+	for _, s := range sets {
+		files += len(s.Files)
+		wasted += s.Wasted
+		if jsonOut {
+			b, _ := json.Marshal(s)
+			fmt.Fprintf(w, "%s\n", b)
+			continue
+		}
+		size := "size unknown"
+		if s.Size >= 0 {
+			size = formatBytes(s.Size) + " each"
+		}
+		fmt.Fprintf(w, "# %d files, %s, %s wasted, %s\n", len(s.Files), size, formatBytes(s.Wasted), s.Hash)
+		for _, f := range s.Files {
+			fmt.Fprintln(w, f)
+		}
+		fmt.Fprintln(w)
+	}
+	if jsonOut {
+		b, _ := json.Marshal(map[string]any{"summary": map[string]any{"sets": len(sets), "files": files, "wasted": wasted}})
+		fmt.Fprintf(w, "%s\n", b)
+		return
+	}
+	fmt.Fprintf(w, "Sets:%d Files:%d Wasted:%s\n", len(sets), files, formatBytes(wasted))
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+	"syscall"
+)
+
+// errorRecordPrefix starts a text error record. Because it begins with '#'
+// readers that only want checksums skip it like a header line.
+const errorRecordPrefix = "# error\t"
+
+// errorRecord is the JSONL form of a file that could not be hashed.
+type errorRecord struct {
+	Path    string `json:"path"`
+	Class   string `json:"class"`
+	Message string `json:"error"`
+}
+
+// errorClass sorts err into a coarse category for reports.
+func errorClass(err error) string {
+	switch {
+	case errors.Is(err, errUnstable):
+		return "unstable"
+	case errors.Is(err, errReadTimeout):
+		return "timeout"
+	case errors.Is(err, fs.ErrNotExist):
+		return "notfound"
+	case errors.Is(err, fs.ErrPermission):
+		return "permission"
+	case errors.Is(err, syscall.EIO):
+		return "io"
+	case errors.Is(err, syscall.EISDIR):
+		return "notfile"
+	}
+	return "other"
+}
+
+// errorMessage returns err without the path it usually repeats, on a single
+// line.
+func errorMessage(err error) string {
+	msg := err.Error()
+	var pe *fs.PathError
+	if errors.As(err, &pe) {
+		msg = pe.Op + ": " + pe.Err.Error()
+	}
+	return strings.Join(strings.Fields(msg), " ")
+}
+
+// formatErrorRecord renders the failure of path as a list line. Text records
+// are "# error<TAB>class<TAB>message<TAB>path" so the path, as in checksum
+// lines, is the last field.
+func formatErrorRecord(path string, err error, jsonOut bool) string {
+	if jsonOut {
+		b, _ := json.Marshal(errorRecord{Path: path, Class: errorClass(err), Message: errorMessage(err)})
+		return string(b) + "\n"
+	}
+	return fmt.Sprintf("%s%s\t%s\t%s\n", errorRecordPrefix, errorClass(err), errorMessage(err), path)
+}
+
+// parseErrorRecord reports whether line is an error record and returns it.
+func parseErrorRecord(line string, jsonIn bool) (errorRecord, bool) {
+	var r errorRecord
+	if jsonIn {
+		if !strings.Contains(line, `"error"`) {
+			return r, false
+		}
+		if json.Unmarshal([]byte(line), &r) != nil || r.Message == "" {
+			return r, false
+		}
+		return r, true
+	}
+	rest, ok := strings.CutPrefix(line, errorRecordPrefix)
+	if !ok {
+		return r, false
+	}
+	parts := strings.SplitN(rest, "\t", 3)
+	if len(parts) != 3 {
+		return r, false
+	}
+	r.Class, r.Message, r.Path = parts[0], parts[1], parts[2]
+	return r, true
+}
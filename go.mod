@@ -6,12 +6,13 @@ require (
 	github.com/cespare/xxhash/v2 v2.3.0
 	github.com/dgryski/go-t1ha v0.0.0-20170624085304-d42c050643ba
 	github.com/klauspost/cpuid/v2 v2.2.3
+	github.com/mattn/go-sqlite3 v1.14.33
 	github.com/minio/blake2b-simd v0.0.0-20160723061019-3f5f724cb5b1
 	github.com/minio/highwayhash v1.0.3
 	github.com/minio/sha256-simd v1.0.1
 	github.com/zeebo/blake3 v0.2.4
 	github.com/zeebo/wyhash v0.0.1
 	github.com/zeebo/xxh3 v1.0.2
+	golang.org/x/crypto v0.41.0
+	golang.org/x/sys v0.35.0
 )
-
-require golang.org/x/sys v0.21.0 // indirect
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// hashdeepMagic is the first line of a hashdeep file.
+const hashdeepMagic = "%%%% HASHDEEP-1.0"
+
+// hashdeepAlgorithms lists the hashdeep columns the hash engine can
+// compute, weakest first. hashdeep also knows tiger and whirlpool; such
+// columns are read but ignored.
+var hashdeepAlgorithms = []string{"md5", "sha1", "sha256"}
+
+// hashdeepEntry is one file of a hashdeep file.
+type hashdeepEntry struct {
+	size int64
+	sums map[string]string // by algorithm
+	path string
+}
+
+// isHashdeepList reports whether listfile is in hashdeep format.
+func isHashdeepList(listfile string) bool {
+	f, err := os.Open(listfile)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	line, _ := bufio.NewReader(f).ReadString('\n')
+	return strings.TrimRight(line, "\r\n") == hashdeepMagic
+}
+
+// readHashdeep parses a hashdeep file and returns its hash columns, in file
+// order, and its entries.
+func readHashdeep(listfile string) ([]string, []hashdeepEntry, error) {
+	f, err := os.Open(listfile)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	var columns []string
+	var entries []hashdeepEntry
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		switch {
+		case n == 1:
+			if line != hashdeepMagic {
+				return nil, nil, fmt.Errorf("%s: not a hashdeep file", listfile)
+			}
+			continue
+		case strings.HasPrefix(line, "%%%% "):
+			columns = strings.Split(strings.TrimPrefix(line, "%%%% "), ",")
+			if len(columns) < 3 || columns[0] != "size" || columns[len(columns)-1] != "filename" {
+				return nil, nil, fmt.Errorf("%s:%d: unsupported hashdeep columns", listfile, n)
+			}
+			continue
+		case line == "" || strings.HasPrefix(line, "#"):
+			continue
+		case columns == nil:
+			return nil, nil, fmt.Errorf("%s:%d: entry before the column header", listfile, n)
+		}
+		// The file name is last and may itself contain commas.
+		fields := strings.SplitN(line, ",", len(columns))
+		if len(fields) != len(columns) {
+			return nil, nil, fmt.Errorf("%s:%d: malformed hashdeep line", listfile, n)
+		}
+		size, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s:%d: malformed size", listfile, n)
+		}
+		e := hashdeepEntry{size: size, sums: map[string]string{}, path: fields[len(fields)-1]}
+		for i, c := range columns[1 : len(columns)-1] {
+			e.sums[c] = strings.ToLower(fields[i+1])
+		}
+		entries = append(entries, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	if columns == nil {
+		return nil, nil, fmt.Errorf("%s: no column header", listfile)
+	}
+	return columns[1 : len(columns)-1], entries, nil
+}
+
+// strongestColumn returns the strongest algorithm of hashdeepAlgorithms
+// found in every one of columns, or "" if there is none.
+func strongestColumn(columns ...[]string) string {
+	for _, a := range slices.Backward(hashdeepAlgorithms) {
+		if !slices.ContainsFunc(columns, func(c []string) bool { return !slices.Contains(c, a) }) {
+			return a
+		}
+	}
+	return ""
+}
+
+// hashdeepListEntries returns the entries of a hashdeep file as checksum
+// list entries for algo, so verify can check them. An empty algo selects
+// the strongest column.
+func hashdeepListEntries(listfile, algo string) ([]listEntry, error) {
+	columns, entries, err := readHashdeep(listfile)
+	if err != nil {
+		return nil, err
+	}
+	if algo == "" {
+		if algo = strongestColumn(columns); algo == "" {
+			return nil, fmt.Errorf("%s has none of the columns %s", listfile, strings.Join(hashdeepAlgorithms, ", "))
+		}
+	}
+	if !slices.Contains(columns, algo) {
+		return nil, fmt.Errorf("%s has no %s column (it has %s); pass one with -hash", listfile, algo, strings.Join(columns, ", "))
+	}
+	list := make([]listEntry, len(entries))
+	for i, e := range entries {
+		list[i] = listEntry{hash: e.sums[algo], path: strings.ReplaceAll(e.path, "\\", "/")}
+	}
+	return list, nil
+}
+
+// runHashdeep implements the hashdeep subcommand. Without -audit it prints
+// hashdeep output for the files under the given directories; with -audit
+// it checks them against a known hashdeep file the way hashdeep -a does.
+// The audit is a separate path from -verify, with hashdeep's results
+// rather than verify statuses, so -show and the reporters do not apply.
+// The exit status is 0 on success or a passed audit, 1 for a failed audit
+// and 2 on error.
+func runHashdeep(args []string) int {
+	fs := flag.NewFlagSet("hashdeep", flag.ExitOnError)
+	algos := fs.String("hash", "md5,sha256", "comma-separated hash columns: md5, sha1, sha256")
+	audit := fs.String("audit", "", "audit the directories against this known hashdeep file")
+	output := fs.String("o", "", "write the hashdeep file here instead of to stdout")
+	verbose := fs.Bool("verbose", false, "with -audit, also print matched files")
+	progress := fs.Bool("progress", false, "show progress updates")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s hashdeep [-hash md5,sha256] [-o FILE] DIR...\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "       %s hashdeep -audit KNOWN DIR...\n", os.Args[0])
+		fmt.Fprintln(fs.Output(), "The audit reports hashdeep's MATCHED, MOVED, PARTIAL, NEW and MISSING, not")
+		fmt.Fprintln(fs.Output(), "verify statuses, and takes no -show or -report; for those, use")
+		fmt.Fprintf(fs.Output(), "%s -verify -list KNOWN -hash ALGO.\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	ctx := signalContext()
+
+	var known []hashdeepEntry
+	var columns []string
+	if *audit != "" {
+		all, entries, err := readHashdeep(*audit)
+		if err != nil {
+			log.Print(err)
+			return 2
+		}
+		for _, c := range all {
+			if slices.Contains(hashdeepAlgorithms, c) {
+				columns = append(columns, c)
+			}
+		}
+		if len(columns) == 0 {
+			log.Printf("%s has none of the columns %s", *audit, strings.Join(hashdeepAlgorithms, ", "))
+			return 2
+		}
+		known = entries
+	} else {
+		for _, a := range strings.Split(*algos, ",") {
+			a = strings.ToLower(strings.TrimSpace(a))
+			if !slices.Contains(hashdeepAlgorithms, a) {
+				log.Printf("-hash: hashdeep has no %q column", a)
+				return 2
+			}
+			columns = append(columns, a)
+		}
+	}
+
+	entries, failed, err := hashdeepScan(ctx, fs.Args(), columns, *progress)
+	if err == errInterrupted {
+		return 130
+	}
+	if err != nil {
+		log.Print(err)
+		return 2
+	}
+
+	if *audit != "" {
+		if !auditHashdeep(os.Stdout, known, entries, columns, *verbose) || failed > 0 {
+			return 1
+		}
+		return 0
+	}
+	w := io.Writer(os.Stdout)
+	var f *os.File
+	if *output != "" {
+		if f, err = os.Create(*output); err != nil {
+			log.Print(err)
+			return 2
+		}
+		w = f
+	}
+	bw := bufio.NewWriter(w)
+	writeHashdeep(bw, columns, entries, os.Args)
+	if f != nil {
+		err = finishFile(f, bw)
+	} else {
+		err = bw.Flush()
+	}
+	if err != nil {
+		log.Print(err)
+		return 2
+	}
+	if failed > 0 {
+		return 2
+	}
+	return 0
+}
+
+// hashdeepScan hashes the regular files under dirs with every algorithm in
+// columns. Files that fail are logged, counted and left out.
+func hashdeepScan(ctx context.Context, dirs, columns []string, progress bool) ([]hashdeepEntry, int, error) {
+	var paths []string
+	sizes := map[string]int64{}
+	for _, d := range dirs {
+		ps, infos, err := walkRegular(ctx, d)
+		if err != nil {
+			return nil, 0, err
+		}
+		paths = append(paths, ps...)
+		for p, fi := range infos {
+			sizes[p] = fi.Size()
+		}
+	}
+	sums, err := hashAll(ctx, paths, func(p string, read *atomic.Int64) (map[string]string, error) {
+		return hashMultiWithRetry(ctx, p, columns, read)
+	}, progress)
+	if err != nil {
+		return nil, 0, err
+	}
+	var entries []hashdeepEntry
+	failed := 0
+	for _, p := range paths {
+		s, ok := sums[p]
+		if !ok {
+			failed++
+			continue
+		}
+		entries = append(entries, hashdeepEntry{size: sizes[p], sums: s, path: p})
+	}
+	return entries, failed, nil
+}
+
+// writeHashdeep writes entries in hashdeep format, with the same header
+// hashdeep writes.
+func writeHashdeep(w io.Writer, columns []string, entries []hashdeepEntry, command []string) {
+	fmt.Fprintln(w, hashdeepMagic)
+	fmt.Fprintf(w, "%%%%%%%% size,%s,filename\n", strings.Join(columns, ","))
+	wd, _ := os.Getwd()
+	fmt.Fprintf(w, "## Invoked from: %s\n", wd)
+	fmt.Fprintf(w, "## $ %s\n", strings.Join(command, " "))
+	fmt.Fprintln(w, "##")
+	for _, e := range entries {
+		fmt.Fprintf(w, "%d", e.size)
+		for _, c := range columns {
+			fmt.Fprintf(w, ",%s", e.sums[c])
+		}
+		fmt.Fprintf(w, ",%s\n", e.path)
+	}
+}
+
+// auditHashdeep compares the files found with the known set by content, as
+// hashdeep -a does, and prints every file that is not an exact match
+// followed by the totals. A file is matched if a known file has the same
+// size and hashes and the same path, and moved if only the path differs.
+// It is a partial match if only some of its hashes match a known file and
+// new if none do. Known files matched by nothing are missing. The audit
+// passes when there are no new, partially matched or missing files.
+func auditHashdeep(w io.Writer, known, found []hashdeepEntry, columns []string, verbose bool) bool {
+	// Paths are compared relative to the root of each side, as diff does,
+	// so that an audit of a copy elsewhere lines up.
+	pathsOf := func(entries []hashdeepEntry) []string {
+		paths := make([]string, len(entries))
+		for i, e := range entries {
+			paths[i] = e.path
+		}
+		return paths
+	}
+	knownPaths, foundPaths := alignPaths(pathsOf(known), pathsOf(found))
+
+	// index[c][hash] lists the known files with that hash in column c.
+	index := map[string]map[string][]int{}
+	for _, c := range columns {
+		index[c] = map[string][]int{}
+		for i, k := range known {
+			if h := k.sums[c]; h != "" {
+				index[c][h] = append(index[c][h], i)
+			}
+		}
+	}
+	used := make([]bool, len(known))
+	var matched, moved, partial, added int
+	for i, f := range found {
+		var full []int
+		some := false
+		for _, k := range index[columns[0]][f.sums[columns[0]]] {
+			same := known[k].size == f.size
+			for _, c := range columns[1:] {
+				same = same && known[k].sums[c] == f.sums[c]
+			}
+			if same {
+				full = append(full, k)
+			}
+		}
+		for _, c := range columns {
+			some = some || len(index[c][f.sums[c]]) > 0
+		}
+		samePath := slices.IndexFunc(full, func(k int) bool { return knownPaths[k] == foundPaths[i] })
+		switch {
+		case samePath >= 0:
+			matched++
+			used[full[samePath]] = true
+			if verbose {
+				fmt.Fprintf(w, "%s MATCHED\n", f.path)
+			}
+		case len(full) > 0:
+			moved++
+			from := full[0]
+			for _, k := range full {
+				if !used[k] {
+					from = k
+					break
+				}
+			}
+			used[from] = true
+			fmt.Fprintf(w, "%s MOVED (from %s)\n", f.path, known[from].path)
+		case some:
+			partial++
+			fmt.Fprintf(w, "%s PARTIAL\n", f.path)
+		default:
+			added++
+			fmt.Fprintf(w, "%s NEW\n", f.path)
+		}
+	}
+	missing := 0
+	for k, u := range used {
+		if !u {
+			missing++
+			fmt.Fprintf(w, "%s MISSING\n", known[k].path)
+		}
+	}
+
+	passed := added == 0 && partial == 0 && missing == 0
+	if passed {
+		fmt.Fprintln(w, "Audit passed")
+	} else {
+		fmt.Fprintln(w, "Audit failed")
+	}
+	fmt.Fprintf(w, "Examined:%d Known:%d Matched:%d Moved:%d Partial:%d New:%d Missing:%d\n",
+		len(found), len(known), matched, moved, partial, added, missing)
+	return passed
+}
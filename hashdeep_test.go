@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestReadHashdeepNoColumnHeader(t *testing.T) {
+	empty := filepath.Join(t.TempDir(), "empty.txt")
+	if err := os.WriteFile(empty, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for name, list := range map[string]string{
+		"empty":      empty,
+		"magic only": writeTestList(t, hashdeepMagic),
+		"comments":   writeTestList(t, hashdeepMagic, "## Invoked from: /data", "##"),
+	} {
+		if _, _, err := readHashdeep(list); err == nil || !strings.Contains(err.Error(), "no column header") {
+			t.Errorf("%s: err = %v, want no column header", name, err)
+		}
+	}
+}
+
+func TestReadHashdeep(t *testing.T) {
+	list := writeTestList(t,
+		hashdeepMagic,
+		"%%%% size,md5,sha256,filename",
+		"## Invoked from: /data",
+		"3,ABC,def,/data/a,b.txt",
+	)
+	columns, entries, err := readHashdeep(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(columns, []string{"md5", "sha256"}) {
+		t.Errorf("columns = %q", columns)
+	}
+	if len(entries) != 1 || entries[0].path != "/data/a,b.txt" || entries[0].size != 3 || entries[0].sums["md5"] != "abc" {
+		t.Errorf("entries = %+v", entries)
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bufio"
+	"html/template"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"time"
+)
+
+// Limits on what the HTML report lists individually; the summary and the
+// histogram always cover every file.
+const (
+	htmlMaxFailures = 10000
+	htmlMaxDirs     = 1000
+	htmlMaxRuns     = 100
+)
+
+// htmlReporter collects results into a self-contained HTML page. It keeps
+// only the failures and per-directory aggregates, not every result.
+type htmlReporter struct {
+	path, mode, dir, list, algo string
+	catalog                     string // -db, for the run history
+	started                     time.Time
+
+	counts   [numStatuses]int
+	bytes    int64
+	failures []fileResult
+	dirs     map[string]*dirRollup
+	hist     [len(histBuckets)]histBucket
+}
+
+type dirRollup struct {
+	Dir      string
+	Files    int
+	Bytes    int64
+	Failures int
+}
+
+type histBucket struct {
+	Label string
+	Files int
+	Bytes int64
+	Width int
+}
+
+// histBuckets are the upper bounds of the size histogram; each is 16 times
+// the previous.
+var histBuckets = [...]string{"0 B", "< 1 KiB", "< 16 KiB", "< 256 KiB", "< 4 MiB", "< 64 MiB", "< 1 GiB", "< 16 GiB", "< 256 GiB", "≥ 256 GiB"}
+
+func histIndex(size int64) int {
+	if size <= 0 {
+		return 0
+	}
+	if size < 1024 {
+		return 1
+	}
+	// Bucket 2 holds 1 to 15 KiB, each further one 16 times as much.
+	kib := uint64(size) / 1024
+	return min(2+(bits.Len64(kib)-1)/4, len(histBuckets)-1)
+}
+
+// newHTMLReporter creates an HTML report written to path when closed. mode
+// is "verify" or "generate"; the rest describes the run. With -db the
+// report also lists the catalog's runs over dir.
+func newHTMLReporter(path, mode, dir, list, algo string) (*htmlReporter, error) {
+	// Fail early rather than after hours of hashing.
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	return &htmlReporter{
+		path: path, mode: mode, dir: dir, list: list, algo: algo,
+		catalog: catalogPath,
+		started: time.Now(),
+		dirs:    map[string]*dirRollup{},
+	}, nil
+}
+
+func (h *htmlReporter) add(r fileResult) error {
+	h.counts[r.status]++
+	h.bytes += r.size
+	b := &h.hist[histIndex(r.size)]
+	b.Files++
+	b.Bytes += r.size
+
+	d := h.dirs[filepath.Dir(r.path)]
+	if d == nil {
+		d = &dirRollup{Dir: filepath.Dir(r.path)}
+		h.dirs[d.Dir] = d
+	}
+	d.Files++
+	d.Bytes += r.size
+	if r.status != statusOK {
+		d.Failures++
+		if len(h.failures) < htmlMaxFailures {
+			h.failures = append(h.failures, r)
+		}
+	}
+	return nil
+}
+
+type htmlStatusCount struct {
+	Status string
+	Count  int
+	Bad    bool
+}
+
+type htmlFailure struct {
+	Path, Status, Expected, Actual, Error string
+	Size                                  int64
+	SizeText                              string
+}
+
+type htmlPage struct {
+	Mode, Dir, List, Catalog, Algo, Started string
+	Elapsed                                 string
+	Total, Files                            int
+	BytesText                               string
+	Counts                                  []htmlStatusCount
+	Failures                                []htmlFailure
+	FailuresTotal                           int
+	FailuresCut                             bool
+	Dirs                                    []*dirRollup
+	DirsTotal                               int
+	DirsCut                                 bool
+	Hist                                    []histBucket
+	Runs                                    []catalogRun
+	RunsTotal                               int
+	RunsCut                                 bool
+}
+
+func (h *htmlReporter) close(total int, _ [numStatuses]int, elapsed time.Duration) error {
+	p := htmlPage{
+		Mode:      h.mode,
+		Dir:       h.dir,
+		List:      h.list,
+		Catalog:   h.catalog,
+		Algo:      h.algo,
+		Started:   h.started.Format(time.RFC3339),
+		Elapsed:   elapsed.Round(time.Millisecond).String(),
+		Total:     total,
+		BytesText: formatBytes(h.bytes),
+	}
+	failed := 0
+	for s, n := range h.counts {
+		p.Files += n
+		if verifyStatus(s) != statusOK {
+			failed += n
+		}
+		if n > 0 || (verifyStatus(s) != statusNotInList && verifyStatus(s) != statusStale) {
+			p.Counts = append(p.Counts, htmlStatusCount{verifyStatus(s).String(), n, verifyStatus(s) != statusOK && n > 0})
+		}
+	}
+	for _, r := range h.failures {
+		p.Failures = append(p.Failures, htmlFailure{
+			Path: r.path, Status: r.status.String(), Expected: r.expected, Actual: r.actual,
+			Error: r.errorText(), Size: r.size, SizeText: formatBytes(r.size),
+		})
+	}
+	p.FailuresTotal = failed
+	p.FailuresCut = failed > len(h.failures)
+
+	for _, d := range h.dirs {
+		p.Dirs = append(p.Dirs, d)
+	}
+	sort.Slice(p.Dirs, func(i, j int) bool {
+		a, b := p.Dirs[i], p.Dirs[j]
+		if a.Failures != b.Failures {
+			return a.Failures > b.Failures
+		}
+		return a.Dir < b.Dir
+	})
+	p.DirsTotal = len(p.Dirs)
+	if len(p.Dirs) > htmlMaxDirs {
+		p.Dirs, p.DirsCut = p.Dirs[:htmlMaxDirs], true
+	}
+
+	most := 1
+	for _, b := range h.hist {
+		most = max(most, b.Files)
+	}
+	for i, b := range h.hist {
+		b.Label = histBuckets[i]
+		b.Width = b.Files * 100 / most
+		p.Hist = append(p.Hist, b)
+	}
+
+	if h.catalog != "" {
+		runs, err := h.history()
+		if err != nil {
+			return err
+		}
+		// The most recent runs, newest first.
+		slices.Reverse(runs)
+		p.RunsTotal = len(runs)
+		if len(runs) > htmlMaxRuns {
+			runs, p.RunsCut = runs[:htmlMaxRuns], true
+		}
+		p.Runs = runs
+	}
+
+	f, err := os.Create(h.path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if err := htmlTemplate.Execute(w, p); err != nil {
+		f.Close()
+		return err
+	}
+	return finishFile(f, w)
+}
+
+// history reads the catalog's runs over the reported directory.
+func (h *htmlReporter) history() ([]catalogRun, error) {
+	c, err := openCatalog(h.catalog)
+	if err != nil {
+		return nil, err
+	}
+	defer c.close()
+	abs, err := filepath.Abs(h.dir)
+	if err != nil {
+		return nil, err
+	}
+	return c.runs(abs)
+}
+
+var htmlTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"bytes": formatBytes,
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>CheckSumFolder {{.Mode}} report</title>
+<style>
+body { font: 14px/1.4 system-ui, sans-serif; margin: 2em; color: #222; }
+h1 { font-size: 1.4em; } h2 { font-size: 1.1em; margin-top: 2em; }
+table { border-collapse: collapse; margin: .5em 0; }
+th, td { border: 1px solid #ccc; padding: .25em .6em; text-align: left; vertical-align: top; }
+th { background: #f3f3f3; }
+table.sortable th { cursor: pointer; user-select: none; }
+table.sortable th:after { content: " \2195"; color: #999; }
+td.num { text-align: right; font-variant-numeric: tabular-nums; }
+td.hash { font-family: monospace; font-size: .85em; word-break: break-all; }
+.bad { color: #b00; font-weight: bold; }
+.ok { color: #070; }
+.bar { background: #4a7bd0; height: 1em; }
+.note { color: #666; }
+dl { display: grid; grid-template-columns: max-content auto; gap: .2em 1em; }
+dt { font-weight: bold; }
+</style>
+</head>
+<body>
+<h1>CheckSumFolder {{.Mode}} report</h1>
+<dl>
+<dt>Directory</dt><dd>{{.Dir}}</dd>
+{{if .List}}<dt>List</dt><dd>{{.List}}</dd>{{end}}
+{{if .Catalog}}<dt>Catalog</dt><dd>{{.Catalog}}</dd>{{end}}
+<dt>Hash</dt><dd>{{.Algo}}</dd>
+<dt>Started</dt><dd>{{.Started}}</dd>
+<dt>Elapsed</dt><dd>{{.Elapsed}}</dd>
+<dt>Files</dt><dd>{{.Files}}{{if ne .Files .Total}} of {{.Total}}{{end}} ({{.BytesText}})</dd>
+</dl>
+
+<h2>Summary</h2>
+<table>
+<tr>{{range .Counts}}<th>{{.Status}}</th>{{end}}</tr>
+<tr>{{range .Counts}}<td class="num {{if .Bad}}bad{{else if eq .Status "OK"}}ok{{end}}">{{.Count}}</td>{{end}}</tr>
+</table>
+
+<h2>Failures</h2>
+{{if .Failures}}
+{{if .FailuresCut}}<p class="note">Showing the first {{len .Failures}} of {{.FailuresTotal}} failures.</p>{{end}}
+<table class="sortable">
+<thead><tr><th>Path</th><th>Status</th><th>Size</th><th>Expected</th><th>Actual</th><th>Error</th></tr></thead>
+<tbody>
+{{range .Failures}}<tr><td>{{.Path}}</td><td class="bad">{{.Status}}</td><td class="num" data-v="{{.Size}}">{{.SizeText}}</td><td class="hash">{{.Expected}}</td><td class="hash">{{.Actual}}</td><td>{{.Error}}</td></tr>
+{{end}}</tbody>
+</table>
+{{else}}<p class="ok">No failures.</p>{{end}}
+
+<h2>Directories</h2>
+{{if .DirsCut}}<p class="note">Showing {{len .Dirs}} of {{.DirsTotal}} directories, those with the most failures first.</p>{{end}}
+<table class="sortable">
+<thead><tr><th>Directory</th><th>Files</th><th>Size</th><th>Failures</th></tr></thead>
+<tbody>
+{{range .Dirs}}<tr><td>{{.Dir}}</td><td class="num">{{.Files}}</td><td class="num" data-v="{{.Bytes}}">{{bytes .Bytes}}</td><td class="num{{if .Failures}} bad{{end}}">{{.Failures}}</td></tr>
+{{end}}</tbody>
+</table>
+
+<h2>File sizes</h2>
+<table>
+<thead><tr><th>Size</th><th>Files</th><th>Total</th><th style="width:20em"></th></tr></thead>
+<tbody>
+{{range .Hist}}<tr><td>{{.Label}}</td><td class="num">{{.Files}}</td><td class="num">{{bytes .Bytes}}</td><td><div class="bar" style="width:{{.Width}}%"></div></td></tr>
+{{end}}</tbody>
+</table>
+
+{{if .Catalog}}
+<h2>History</h2>
+{{if .RunsCut}}<p class="note">Showing the latest {{len .Runs}} of {{.RunsTotal}} runs.</p>{{end}}
+<table class="sortable">
+<thead><tr><th>Run</th><th>Mode</th><th>Hash</th><th>Started</th><th>Finished</th><th>Files</th><th>Failures</th></tr></thead>
+<tbody>
+{{range .Runs}}<tr><td class="num">{{.ID}}</td><td>{{.Mode}}</td><td>{{.Algo}}</td><td>{{.Started}}</td><td>{{if .Finished}}{{.Finished}}{{else}}<span class="note">unfinished</span>{{end}}</td><td class="num">{{.Files}}</td><td class="num{{if .Failed}} bad{{end}}">{{.Failed}}</td></tr>
+{{end}}</tbody>
+</table>
+{{end}}
+
+<script>
+document.querySelectorAll("table.sortable").forEach(function (table) {
+  table.querySelectorAll("th").forEach(function (th, col) {
+    var asc = true;
+    th.addEventListener("click", function () {
+      var body = table.tBodies[0];
+      var rows = Array.prototype.slice.call(body.rows);
+      var key = function (row) {
+        var cell = row.cells[col];
+        var v = cell.getAttribute("data-v");
+        if (v !== null) return parseFloat(v);
+        var t = cell.textContent;
+        return cell.classList.contains("num") ? parseFloat(t) : t;
+      };
+      rows.sort(function (a, b) {
+        var x = key(a), y = key(b);
+        var c = x < y ? -1 : x > y ? 1 : 0;
+        return asc ? c : -c;
+      });
+      asc = !asc;
+      rows.forEach(function (r) { body.appendChild(r); });
+    });
+  });
+});
+</script>
+</body>
+</html>
+`))
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	cpuid "github.com/klauspost/cpuid/v2"
+)
+
+// listHeader records how a checksum list was produced. It is written as
+// the first lines of a new list so a reader can tell which build, CPU and
+// implementation generated the hashes.
+type listHeader struct {
+	Tool     string   `json:"tool"`
+	Version  string   `json:"version"`
+	Go       string   `json:"go"`
+	OS       string   `json:"os"`
+	Arch     string   `json:"arch"`
+	ArchOpt  string   `json:"arch_opt,omitempty"`
+	CGO      bool     `json:"cgo"`
+	CPU      string   `json:"cpu"`
+	Features []string `json:"features"`
+	Hash     string   `json:"hash"`
+	Backend  string   `json:"backend"`
+	Key      string   `json:"key,omitempty"`
+	KeyID    string   `json:"key_id,omitempty"`
+	SeedID   string   `json:"seed_id,omitempty"`
+	Created  string   `json:"created"`
+}
+
+// buildSettings returns the interesting fields of the embedded build info.
+func buildSettings() (version string, cgo bool, archOpt string) {
+	version = "(devel)"
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return
+	}
+	if bi.Main.Version != "" {
+		version = bi.Main.Version
+	}
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "CGO_ENABLED":
+			cgo = s.Value == "1"
+		case "GOARM", "GOAMD64", "GOARM64", "GO386":
+			archOpt = s.Key + "=" + s.Value
+		case "vcs.revision":
+			if version == "(devel)" && len(s.Value) >= 12 {
+				version = "(devel " + s.Value[:12] + ")"
+			}
+		}
+	}
+	return
+}
+
+func newListHeader(algo string) listHeader {
+	version, cgo, archOpt := buildSettings()
+	h := listHeader{
+		Tool:     "CheckSumFolder",
+		Version:  version,
+		Go:       runtime.Version(),
+		OS:       runtime.GOOS,
+		Arch:     runtime.GOARCH,
+		ArchOpt:  archOpt,
+		CGO:      cgo,
+		CPU:      strings.TrimSpace(cpuid.CPU.BrandName),
+		Features: cpuid.CPU.FeatureSet(),
+		Hash:     strings.ToLower(algo),
+		Backend:  backendOf(algo),
+		Created:  time.Now().UTC().Format(time.RFC3339),
+	}
+	if hashKey != nil {
+		h.Key = keySource
+		h.KeyID = keyID(hashKey)
+	}
+	if seeded {
+		h.SeedID = seedID(hashSeed)
+	}
+	return h
+}
+
+func (h listHeader) buildLine() string {
+	cgo := "off"
+	if h.CGO {
+		cgo = "on"
+	}
+	s := fmt.Sprintf("%s %s %s %s/%s cgo=%s", h.Tool, h.Version, h.Go, h.OS, h.Arch, cgo)
+	if h.ArchOpt != "" {
+		s += " " + h.ArchOpt
+	}
+	return s
+}
+
+// writeTo renders the header as comment lines for text lists or as a single
+// {"header":...} object for JSONL lists.
+func (h listHeader) writeTo(w io.Writer, jsonOut bool) error {
+	if jsonOut {
+		b, err := json.Marshal(map[string]listHeader{"header": h})
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", b)
+		return err
+	}
+	_, err := fmt.Fprintf(w, "# %s\n# cpu: %s\n# features: %s\n# hash: %s backend: %s\n",
+		h.buildLine(), h.CPU, strings.Join(h.Features, ","), h.Hash, h.Backend)
+	if err == nil && h.KeyID != "" {
+		_, err = fmt.Fprintf(w, "# key: %s id=%s\n", h.Key, h.KeyID)
+	}
+	if err == nil && h.SeedID != "" {
+		_, err = fmt.Fprintf(w, "# seed: id=%s\n", h.SeedID)
+	}
+	if err == nil {
+		_, err = fmt.Fprintf(w, "# created: %s\n", h.Created)
+	}
+	return err
+}
+
+// isHeaderLine reports whether a list line belongs to the header rather
+// than being a checksum entry.
+func isHeaderLine(line string) bool {
+	return strings.HasPrefix(line, "#") || strings.HasPrefix(line, `{"header":`)
+}
+
+// printInfo writes the build details, detected CPU features and the
+// implementation chosen for every algorithm.
+func printInfo(w io.Writer) {
+	h := newListHeader("")
+	fmt.Fprintln(w, h.buildLine())
+	fmt.Fprintf(w, "CPU: %s (%s, %d logical cores)\n", h.CPU, cpuid.CPU.VendorString, runtime.NumCPU())
+	fmt.Fprintf(w, "Features: %s\n", strings.Join(h.Features, " "))
+	fmt.Fprintln(w, "Backends:")
+	for _, a := range algorithms {
+		fmt.Fprintf(w, "  %-11s %-45s [%s]\n", a, backendOf(a), strings.Join(implChoices[a], "|"))
+	}
+}
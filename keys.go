@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	stdsha256 "crypto/sha256"
+)
+
+// hashKey and hashSeed configure keyed and seeded hashing. They are set
+// from -key and -seed; keySource describes where the key came from and is
+// the only part of it that is ever written to a list.
+var (
+	hashKey   []byte
+	keySource string
+	hashSeed  uint64
+	seeded    bool
+)
+
+// keyedAlgorithms maps the algorithms accepting -key to a description of
+// the mode used.
+var keyedAlgorithms = map[string]string{
+	"sha256":     "HMAC-SHA256",
+	"blake2b":    "BLAKE2b keyed",
+	"blake3":     "BLAKE3 keyed",
+	"highway64":  "HighwayHash",
+	"highway128": "HighwayHash",
+	"highway256": "HighwayHash",
+}
+
+// seededAlgorithms lists the algorithms accepting -seed.
+var seededAlgorithms = map[string]bool{
+	"xxhash":    true,
+	"xxh3":      true,
+	"xxh128":    true,
+	"t1ha1":     true,
+	"t1ha2":     true,
+	"wyhash":    true,
+	"rapidhash": true,
+}
+
+// loadKey resolves a -key argument. It accepts hex:VALUE, base64:VALUE,
+// file:PATH (raw bytes), env:NAME (hex or base64) or a bare hex or base64
+// value, and returns the key and a description safe to record.
+func loadKey(spec string) ([]byte, string, error) {
+	kind, val, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "hex":
+		k, err := hex.DecodeString(val)
+		return k, "inline", err
+	case "base64":
+		k, err := base64.StdEncoding.DecodeString(val)
+		return k, "inline", err
+	case "file":
+		k, err := os.ReadFile(val)
+		return k, spec, err
+	case "env":
+		v, ok := os.LookupEnv(val)
+		if !ok {
+			return nil, "", fmt.Errorf("environment variable %s is not set", val)
+		}
+		k, err := decodeKey(v)
+		return k, spec, err
+	}
+	k, err := decodeKey(spec)
+	return k, "inline", err
+}
+
+func decodeKey(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if k, err := hex.DecodeString(s); err == nil {
+		return k, nil
+	}
+	if k, err := base64.StdEncoding.DecodeString(s); err == nil {
+		return k, nil
+	}
+	return nil, fmt.Errorf("key is neither hex nor base64")
+}
+
+// checkKeyLen validates the key length for algo.
+func checkKeyLen(algo string, key []byte) error {
+	switch {
+	case len(key) == 0:
+		return fmt.Errorf("empty key")
+	case (algo == "blake3" || strings.HasPrefix(algo, "highway")) && len(key) != 32:
+		return fmt.Errorf("%s key must be 32 bytes, got %d", algo, len(key))
+	case algo == "blake2b" && len(key) > 64:
+		return fmt.Errorf("blake2b key must be at most 64 bytes, got %d", len(key))
+	}
+	return nil
+}
+
+// parseSeed accepts decimal, 0x hex or 0o octal seeds.
+func parseSeed(s string) (uint64, error) {
+	return strconv.ParseUint(s, 0, 64)
+}
+
+// keyID fingerprints key material so a list can name the key it was made
+// with without revealing it.
+func keyID(b []byte) string {
+	sum := stdsha256.Sum256(append([]byte("CheckSumFolder key id\x00"), b...))
+	return hex.EncodeToString(sum[:8])
+}
+
+func seedID(seed uint64) string {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], seed)
+	return keyID(b[:])
+}
+
+// readListHeader returns the header of an existing list. ok is false when
+// the list has none, e.g. because it predates headers.
+func readListHeader(path string, jsonIn bool) (h listHeader, ok bool, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return h, false, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !isHeaderLine(line) {
+			break
+		}
+		if jsonIn {
+			var e struct {
+				Header *listHeader `json:"header"`
+			}
+			if json.Unmarshal([]byte(line), &e) == nil && e.Header != nil {
+				return *e.Header, true, nil
+			}
+			continue
+		}
+		ok = true
+		switch {
+		case strings.HasPrefix(line, "# hash: "):
+			var rest string
+			h.Hash, rest, _ = strings.Cut(strings.TrimPrefix(line, "# hash: "), " ")
+			h.Backend = strings.TrimPrefix(rest, "backend: ")
+		case strings.HasPrefix(line, "# key: "):
+			h.Key, h.KeyID = splitID(strings.TrimPrefix(line, "# key: "))
+		case strings.HasPrefix(line, "# seed: "):
+			_, h.SeedID = splitID(strings.TrimPrefix(line, "# seed: "))
+		}
+	}
+	return h, ok, scanner.Err()
+}
+
+// splitID splits "source id=abcd" into its parts.
+func splitID(s string) (source, id string) {
+	if i := strings.LastIndex(s, "id="); i >= 0 {
+		return strings.TrimSpace(s[:i]), s[i+len("id="):]
+	}
+	return s, ""
+}
+
+// checkKeying compares the key and seed in use with those recorded in a
+// list header.
+func checkKeying(h listHeader) error {
+	switch {
+	case h.KeyID == "" && hashKey != nil:
+		return fmt.Errorf("list was generated without a key but -key was given")
+	case h.KeyID != "" && hashKey == nil:
+		return fmt.Errorf("list was generated with a key (%s); pass it with -key", h.Key)
+	case h.KeyID != "" && keyID(hashKey) != h.KeyID:
+		return fmt.Errorf("-key does not match the key the list was generated with (%s)", h.Key)
+	case h.SeedID == "" && seeded:
+		return fmt.Errorf("list was generated without a seed but -seed was given")
+	case h.SeedID != "" && !seeded:
+		return fmt.Errorf("list was generated with a seed; pass it with -seed")
+	case h.SeedID != "" && seedID(hashSeed) != h.SeedID:
+		return fmt.Errorf("-seed does not match the seed the list was generated with")
+	}
+	return nil
+}
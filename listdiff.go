@@ -0,0 +1,327 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"slices"
+	"strings"
+)
+
+// listDiff is the difference between an old and a new checksum list. Paths
+// are relative to the root of each list (see alignPaths).
+type listDiff struct {
+	Added     []string       `json:"added"`
+	Removed   []string       `json:"removed"`
+	Modified  []modifiedFile `json:"modified"`
+	Renamed   []movedFile    `json:"renamed"`
+	Moved     []movedFile    `json:"moved"`
+	Unchanged int            `json:"unchanged"`
+}
+
+type modifiedFile struct {
+	Path    string `json:"path"`
+	OldHash string `json:"old_hash"`
+	NewHash string `json:"new_hash"`
+}
+
+// movedFile is a file that disappeared from one path and appeared with the
+// same hash at another: renamed within its directory or moved elsewhere.
+type movedFile struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	Hash string `json:"hash"`
+}
+
+func (d *listDiff) changed() bool {
+	return len(d.Added)+len(d.Removed)+len(d.Modified)+len(d.Renamed)+len(d.Moved) > 0
+}
+
+// runDiff implements the diff subcommand and returns the exit status: 0 if
+// the lists agree, 1 if they differ and 2 on error, like diff(1).
+func runDiff(args []string) int {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	jsonOut := fs.Bool("json", false, "print the differences as JSON")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s diff [-json] OLD NEW\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return 2
+	}
+	d, err := diffLists(fs.Arg(0), fs.Arg(1))
+	if err != nil {
+		log.Print(err)
+		return 2
+	}
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(d)
+	} else {
+		err = d.writeText(os.Stdout)
+	}
+	if err != nil {
+		log.Print(err)
+		return 2
+	}
+	if d.changed() {
+		return 1
+	}
+	return 0
+}
+
+// diffLists compares two lists in any supported format. Files present in
+// only one list but with the same hash are reported as renamed or moved
+// rather than as removed and added.
+func diffLists(oldList, newList string) (*listDiff, error) {
+	algo, err := diffColumn(oldList, newList)
+	if err != nil {
+		return nil, err
+	}
+	oldEntries, oldHdr, err := loadListForDiff(oldList, algo)
+	if err != nil {
+		return nil, err
+	}
+	newEntries, newHdr, err := loadListForDiff(newList, algo)
+	if err != nil {
+		return nil, err
+	}
+	if oldHdr != nil && newHdr != nil {
+		switch {
+		case oldHdr.Hash != newHdr.Hash:
+			return nil, fmt.Errorf("lists use different hashes: %s and %s", oldHdr.Hash, newHdr.Hash)
+		case oldHdr.KeyID != newHdr.KeyID || oldHdr.SeedID != newHdr.SeedID:
+			return nil, fmt.Errorf("lists were made with different keys or seeds")
+		}
+	}
+	oldFiles, newFiles := diffMaps(oldEntries, newEntries)
+
+	d := &listDiff{Added: []string{}, Removed: []string{}, Modified: []modifiedFile{}, Renamed: []movedFile{}, Moved: []movedFile{}}
+	gone := map[string][]string{} // hash -> removed paths
+	for _, p := range sortedKeys(oldFiles) {
+		nh, ok := newFiles[p]
+		switch {
+		case !ok:
+			gone[oldFiles[p]] = append(gone[oldFiles[p]], p)
+		case nh != oldFiles[p]:
+			d.Modified = append(d.Modified, modifiedFile{Path: p, OldHash: oldFiles[p], NewHash: nh})
+		default:
+			d.Unchanged++
+		}
+	}
+	for _, p := range sortedKeys(newFiles) {
+		if _, ok := oldFiles[p]; ok {
+			continue
+		}
+		h := newFiles[p]
+		if from := gone[h]; len(from) > 0 {
+			gone[h] = from[1:]
+			m := movedFile{From: from[0], To: p, Hash: h}
+			if path.Dir(m.From) == path.Dir(m.To) {
+				d.Renamed = append(d.Renamed, m)
+			} else {
+				d.Moved = append(d.Moved, m)
+			}
+			continue
+		}
+		d.Added = append(d.Added, p)
+	}
+	for _, paths := range gone {
+		d.Removed = append(d.Removed, paths...)
+	}
+	slices.Sort(d.Removed)
+	return d, nil
+}
+
+// diffColumn returns the column to read hashdeep files by: the hash in the
+// header of the other list, or the strongest column two hashdeep files
+// share. It is empty if neither list says.
+func diffColumn(oldList, newList string) (string, error) {
+	var columns [][]string
+	for _, l := range []string{oldList, newList} {
+		if isHashdeepList(l) {
+			c, _, err := readHashdeep(l)
+			if err != nil {
+				return "", err
+			}
+			columns = append(columns, c)
+			continue
+		}
+		jsonIn, err := isJSONList(l)
+		if err != nil {
+			return "", err
+		}
+		if h, ok, err := readListHeader(l, jsonIn); err != nil {
+			return "", err
+		} else if ok {
+			return h.Hash, nil
+		}
+	}
+	if len(columns) < 2 {
+		return "", nil
+	}
+	c := strongestColumn(columns...)
+	if c == "" {
+		return "", fmt.Errorf("%s and %s share no hash column", oldList, newList)
+	}
+	return c, nil
+}
+
+// loadListForDiff reads a list and its header, if it has one. A hashdeep
+// file is read by its algo column, or its strongest if algo is empty.
+func loadListForDiff(listfile, algo string) ([]listEntry, *listHeader, error) {
+	if isHashdeepList(listfile) {
+		entries, err := hashdeepListEntries(listfile, algo)
+		if err != nil || algo == "" {
+			return entries, nil, err
+		}
+		return entries, &listHeader{Hash: algo}, nil
+	}
+	jsonIn, err := isJSONList(listfile)
+	if err != nil {
+		return nil, nil, err
+	}
+	var hdr *listHeader
+	if h, ok, err := readListHeader(listfile, jsonIn); err != nil {
+		return nil, nil, err
+	} else if ok {
+		hdr = &h
+	}
+	entries, err := readList(listfile, jsonIn)
+	if err != nil {
+		return nil, nil, err
+	}
+	return entries, hdr, nil
+}
+
+// diffMaps maps the normalized paths of two lists to their hashes.
+func diffMaps(oldEntries, newEntries []listEntry) (oldFiles, newFiles map[string]string) {
+	pathsOf := func(entries []listEntry) []string {
+		paths := make([]string, len(entries))
+		for i, e := range entries {
+			paths[i] = e.path
+		}
+		return paths
+	}
+	oldPaths, newPaths := alignPaths(pathsOf(oldEntries), pathsOf(newEntries))
+	oldFiles = make(map[string]string, len(oldEntries))
+	for i, e := range oldEntries {
+		oldFiles[oldPaths[i]] = e.hash
+	}
+	newFiles = make(map[string]string, len(newEntries))
+	for i, e := range newEntries {
+		newFiles[newPaths[i]] = e.hash
+	}
+	return oldFiles, newFiles
+}
+
+// alignPaths makes the paths of two lists comparable. As in verify,
+// backslashes become slashes and drive letters are dropped. The root each
+// list was generated from is then removed. A list usually holds files
+// throughout its root, but one that only has files below a subdirectory
+// would lose that subdirectory too, so the roots are chosen from both lists
+// together: see listRoots.
+func alignPaths(a, b []string) ([]string, []string) {
+	norm := func(paths []string) []string {
+		out := make([]string, len(paths))
+		for i, p := range paths {
+			out[i], _ = stripDrive(strings.ReplaceAll(p, "\\", "/"))
+		}
+		return out
+	}
+	a, b = norm(a), norm(b)
+	ra, rb := listRoots(commonDir(a), commonDir(b))
+	for i := range a {
+		a[i] = strings.TrimPrefix(a[i], ra)
+	}
+	for i := range b {
+		b[i] = strings.TrimPrefix(b[i], rb)
+	}
+	return a, b
+}
+
+// listRoots picks the roots to remove from two lists whose entries share
+// the directories a and b. Lists generated under the same root share a
+// prefix, which is used for both. Otherwise they come from different
+// places, e.g. H:/photos/ and /mnt/photos/; if one of them only holds files
+// below a subdirectory, its root is cut back to the directory named like
+// the other root, the way verify matches the base name of -dir.
+func listRoots(a, b string) (string, string) {
+	switch {
+	case strings.HasPrefix(a, b):
+		return b, b
+	case strings.HasPrefix(b, a):
+		return a, a
+	}
+	if p := dirNamed(a, path.Base(b)); p != "" {
+		return p, b
+	}
+	if p := dirNamed(b, path.Base(a)); p != "" {
+		return a, p
+	}
+	return a, b
+}
+
+// dirNamed returns the longest directory prefix of p whose last element is
+// name, or "" if there is none.
+func dirNamed(p, name string) string {
+	for p != "" {
+		if path.Base(p) == name {
+			return p
+		}
+		p = p[:strings.LastIndex(strings.TrimSuffix(p, "/"), "/")+1]
+	}
+	return ""
+}
+
+// commonDir returns the longest directory prefix, ending in a slash, shared
+// by all paths.
+func commonDir(paths []string) string {
+	if len(paths) == 0 {
+		return ""
+	}
+	prefix := paths[0][:strings.LastIndex(paths[0], "/")+1]
+	for _, p := range paths[1:] {
+		for !strings.HasPrefix(p, prefix) {
+			prefix = prefix[:strings.LastIndex(strings.TrimSuffix(prefix, "/"), "/")+1]
+		}
+	}
+	return prefix
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func (d *listDiff) writeText(w io.Writer) error {
+	for _, p := range d.Added {
+		fmt.Fprintf(w, "ADDED %s\n", p)
+	}
+	for _, p := range d.Removed {
+		fmt.Fprintf(w, "REMOVED %s\n", p)
+	}
+	for _, m := range d.Modified {
+		fmt.Fprintf(w, "MODIFIED %s\n", m.Path)
+	}
+	for _, m := range d.Renamed {
+		fmt.Fprintf(w, "RENAMED %s -> %s\n", m.From, m.To)
+	}
+	for _, m := range d.Moved {
+		fmt.Fprintf(w, "MOVED %s -> %s\n", m.From, m.To)
+	}
+	_, err := fmt.Fprintf(w, "Added:%d Removed:%d Modified:%d Renamed:%d Moved:%d Unchanged:%d\n",
+		len(d.Added), len(d.Removed), len(d.Modified), len(d.Renamed), len(d.Moved), d.Unchanged)
+	return err
+}
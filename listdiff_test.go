@@ -0,0 +1,132 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func writeTestList(t *testing.T, lines ...string) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), "list.txt")
+	if err := os.WriteFile(p, []byte(strings.Join(lines, "\n")+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestDiffListsAddedAtRoot(t *testing.T) {
+	oldList := writeTestList(t,
+		"aaaa\t/data/photos/2024/a.jpg",
+		"bbbb\t/data/photos/2024/b.jpg",
+	)
+	newList := writeTestList(t,
+		"aaaa\t/data/photos/2024/a.jpg",
+		"bbbb\t/data/photos/2024/b.jpg",
+		"cccc\t/data/photos/c.jpg",
+	)
+	d, err := diffLists(oldList, newList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(d.Added, []string{"c.jpg"}) {
+		t.Errorf("added = %q, want [c.jpg]", d.Added)
+	}
+	if len(d.Removed)+len(d.Modified)+len(d.Renamed)+len(d.Moved) != 0 || d.Unchanged != 2 {
+		t.Errorf("unexpected changes: %+v", d)
+	}
+
+	// The same from the other side: the new list only covers 2024.
+	d, err = diffLists(newList, oldList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(d.Removed, []string{"c.jpg"}) || len(d.Moved) != 0 || d.Unchanged != 2 {
+		t.Errorf("reversed: %+v", d)
+	}
+}
+
+func TestDiffListsDifferentRoots(t *testing.T) {
+	oldList := writeTestList(t,
+		"aaaa\tH:\\photos\\2024\\a.jpg",
+		"bbbb\tH:\\photos\\2024\\b.jpg",
+	)
+	newList := writeTestList(t,
+		"aaaa\t/mnt/backup/photos/2024/a.jpg",
+		"bbbb\t/mnt/backup/photos/2024/old/b.jpg",
+		"cccc\t/mnt/backup/photos/c.jpg",
+	)
+	d, err := diffLists(oldList, newList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(d.Added, []string{"c.jpg"}) || d.Unchanged != 1 {
+		t.Errorf("added = %q, unchanged = %d, want [c.jpg] and 1", d.Added, d.Unchanged)
+	}
+	want := movedFile{From: "2024/b.jpg", To: "2024/old/b.jpg", Hash: "bbbb"}
+	if len(d.Moved) != 1 || d.Moved[0] != want {
+		t.Errorf("moved = %+v, want %+v", d.Moved, want)
+	}
+}
+
+func TestDiffListsRenamedAndModified(t *testing.T) {
+	oldList := writeTestList(t,
+		"aaaa\tphotos/a.jpg",
+		"bbbb\tphotos/b.jpg",
+	)
+	newList := writeTestList(t,
+		"aaaa\tphotos/renamed.jpg",
+		"dddd\tphotos/b.jpg",
+	)
+	d, err := diffLists(oldList, newList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Renamed) != 1 || d.Renamed[0].From != "a.jpg" || d.Renamed[0].To != "renamed.jpg" {
+		t.Errorf("renamed = %+v", d.Renamed)
+	}
+	if len(d.Modified) != 1 || d.Modified[0].Path != "b.jpg" {
+		t.Errorf("modified = %+v", d.Modified)
+	}
+}
+
+func TestDiffListsHashdeep(t *testing.T) {
+	oldList := writeTestList(t,
+		hashdeepMagic,
+		"%%%% size,md5,sha1,sha256,filename",
+		"1,m1,s1,aaaa,/data/a.txt",
+		"1,m2,s2,bbbb,/data/b.txt",
+	)
+	// Compared by sha1, the strongest column both files have.
+	newList := writeTestList(t,
+		hashdeepMagic,
+		"%%%% size,md5,sha1,filename",
+		"1,m1,s1,/data/a.txt",
+		"1,m3,s3,/data/b.txt",
+	)
+	d, err := diffLists(oldList, newList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Modified) != 1 || d.Modified[0] != (modifiedFile{Path: "b.txt", OldHash: "s2", NewHash: "s3"}) || d.Unchanged != 1 {
+		t.Errorf("hashdeep files: %+v", d)
+	}
+
+	// Against a list, by the hash its header records.
+	var b strings.Builder
+	if err := newListHeader("sha256").writeTo(&b, false); err != nil {
+		t.Fatal(err)
+	}
+	list := writeTestList(t, strings.TrimSuffix(b.String(), "\n"), "aaaa\t/data/a.txt", "cccc\t/data/c.txt")
+	if d, err = diffLists(oldList, list); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(d.Added, []string{"c.txt"}) || !slices.Equal(d.Removed, []string{"b.txt"}) || d.Unchanged != 1 {
+		t.Errorf("hashdeep file and list: %+v", d)
+	}
+	if _, err := diffLists(newList, list); err == nil || !strings.Contains(err.Error(), "no sha256 column") {
+		t.Errorf("list by a column the hashdeep file lacks: err = %v", err)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// listEntry is one checksum line of a list. Lists written since size and
+// mtime were recorded also carry those, as they were when the file was
+// hashed.
+type listEntry struct {
+	hash  string
+	path  string
+	size  int64
+	mtime int64 // Unix nanoseconds
+	stat  bool  // size and mtime are known
+}
+
+// listRecord is the JSONL form of a checksum line.
+type listRecord struct {
+	Hash  string `json:"hash"`
+	Size  *int64 `json:"size,omitempty"`
+	MTime *int64 `json:"mtime,omitempty"`
+	Path  string `json:"path"`
+}
+
+// formatListLine renders a checksum line. Text lines are
+// "hash<TAB>size<TAB>mtime<TAB>path", the path last as always.
+func formatListLine(hash, path string, fi os.FileInfo, jsonOut bool) string {
+	size, mtime := fi.Size(), fi.ModTime().UnixNano()
+	if jsonOut {
+		b, _ := json.Marshal(listRecord{Hash: hash, Size: &size, MTime: &mtime, Path: path})
+		return string(b) + "\n"
+	}
+	return fmt.Sprintf("%s\t%d\t%d\t%s\n", hash, size, mtime, path)
+}
+
+// parseListLine parses a checksum line, with or without size and mtime.
+// Header lines, error records and directory records are not checksum
+// lines.
+func parseListLine(line string, jsonIn bool) (listEntry, bool) {
+	var e listEntry
+	if _, ok := parseErrorRecord(line, jsonIn); ok || isHeaderLine(line) {
+		return e, false
+	}
+	if _, ok := parseDirRecord(line, jsonIn); ok {
+		return e, false
+	}
+	if jsonIn {
+		var r listRecord
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			return e, false
+		}
+		e.hash, e.path = r.Hash, r.Path
+		if r.Size != nil && r.MTime != nil {
+			e.size, e.mtime, e.stat = *r.Size, *r.MTime, true
+		}
+		return e, true
+	}
+	parts := strings.SplitN(line, "\t", 4)
+	if len(parts) < 2 {
+		return e, false
+	}
+	e.hash, e.path = parts[0], strings.Join(parts[1:], "\t")
+	// Older lists have just the hash and the path.
+	if len(parts) == 4 {
+		size, err1 := strconv.ParseUint(parts[1], 10, 63)
+		mtime, err2 := strconv.ParseInt(parts[2], 10, 64)
+		if err1 == nil && err2 == nil {
+			e.size, e.mtime, e.stat, e.path = int64(size), mtime, true, parts[3]
+		}
+	}
+	return e, true
+}
+
+// readList returns the checksum entries of a text or JSONL list, skipping
+// header lines, error records and directory records. Backslashes in paths are turned into
+// forward slashes.
+func readList(listfile string, jsonIn bool) ([]listEntry, error) {
+	var entries []listEntry
+	f, err := os.Open(listfile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if e, ok := parseListLine(scanner.Text(), jsonIn); ok {
+			// Normalize all backslashes to forward slashes.
+			// This is crucial for consistent parsing of paths from Windows.
+			e.path = strings.ReplaceAll(e.path, "\\", "/")
+			entries = append(entries, e)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// isJSONList reports whether a list is in JSONL format, judging by its
+// first line.
+func isJSONList(listfile string) (bool, error) {
+	f, err := os.Open(listfile)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" {
+			return strings.HasPrefix(line, "{"), nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+// stripDrive removes a Windows drive letter and the slash following it,
+// e.g. "H:/photos/a.jpg" becomes "photos/a.jpg".
+func stripDrive(p string) (string, bool) {
+	// Check if the path from the list file starts with a Windows drive letter (e.g., "H:/")
+	if !(len(p) >= 2 && p[1] == ':' && (p[0] >= 'A' && p[0] <= 'Z' || p[0] >= 'a' && p[0] <= 'z')) {
+		return p, false
+	}
+	p = p[2:]
+	if strings.HasPrefix(p, "/") || strings.HasPrefix(p, "\\") {
+		p = p[1:]
+	}
+	return p, true
+}
+
+// resolveListPath maps a path from a list, which may come from another
+// system, to the file to check under absDir.
+func resolveListPath(absDir, p string) string {
+	dirBase := filepath.Base(absDir)
+	if rel, ok := stripDrive(p); ok {
+		// If it's a Windows drive path, treat the rest as relative to the
+		// -dir. Now rel is like "_YD_Photo/Фото и видео/..."
+		// Apply the dirBase trimming logic to it.
+		if dirBase != "" && strings.HasPrefix(rel, dirBase+"/") {
+			return filepath.Join(absDir, strings.TrimPrefix(rel, dirBase+"/"))
+		}
+		return filepath.Join(absDir, rel)
+	}
+	if filepath.IsAbs(p) {
+		// If it's a Unix-style absolute path (starts with /), use it directly.
+		// This assumes the absolute path is valid on the current system.
+		return p
+	}
+	// It's a relative path (e.g., "_YD_Photo/..." or "subfolder/...")
+	// Join it with the absolute -dir.
+	// We still need the logic to trim dirBase if present in it.
+	if dirBase != "" && strings.HasPrefix(p, dirBase+"/") {
+		return filepath.Join(absDir, strings.TrimPrefix(p, dirBase+"/"))
+	}
+	return filepath.Join(absDir, p)
+}
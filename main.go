@@ -2,23 +2,30 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"crypto/hmac"
 	"crypto/md5"
 	"crypto/sha1"
 	stdsha256 "crypto/sha256"
+	"crypto/sha512"
 	"encoding/base64"
 	"encoding/binary"
 	"encoding/hex"
-	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"CheckSumFolder/rapidhashc"
@@ -30,7 +37,6 @@ import (
 	"github.com/zeebo/blake3"
 	"github.com/zeebo/xxh3"
 
-	"CheckSumFolder/blake3c"
 	"CheckSumFolder/t1ha"
 
 	"hash"
@@ -45,17 +51,80 @@ var highwayKey = []byte{
 
 const defaultHighwayKey = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
 
+// errInterrupted is returned when a run was stopped by a signal after
+// finishing the files already in flight.
+var errInterrupted = errors.New("interrupted")
+
 func main() {
+	if err := applyImplOverrides(os.Getenv("CHECKSUMFOLDER_IMPL")); err != nil {
+		log.Fatalf("CHECKSUMFOLDER_IMPL: %v", err)
+	}
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "version":
+			printInfo(os.Stdout)
+			return
+		case "diff":
+			os.Exit(runDiff(os.Args[2:]))
+		case "compare":
+			os.Exit(runCompare(os.Args[2:]))
+		case "dupes":
+			os.Exit(runDupes(os.Args[2:]))
+		case "dedupe":
+			os.Exit(runDedupe(os.Args[2:]))
+		case "bag":
+			os.Exit(runBag(os.Args[2:]))
+		case "hashdeep":
+			os.Exit(runHashdeep(os.Args[2:]))
+		case "mtree":
+			os.Exit(runMtree(os.Args[2:]))
+		case "history":
+			os.Exit(runHistory(os.Args[2:]))
+		}
+	}
+
 	dir := flag.String("dir", ".", "directory to scan")
 	list := flag.String("list", "", "checksum list file")
 	verify := flag.Bool("verify", false, "verify mode")
 	verbose := flag.Bool("verbose", false, "verbose verify output")
+	reportFile := flag.String("report", "", "write per-file verify results to this file")
+	htmlReport := flag.String("html-report", "", "write a self-contained HTML report of the run to this file")
+	reportFormat := flag.String("report-format", "json", "format of -report: json|csv|junit")
+	showFlag := flag.String("show", "", "verify statuses to print, e.g. corrupted,missing (ok, mismatch, modified, corrupted, missing, unreadable, unstable, not_in_list or all)")
+	errorsFile := flag.String("errors", "", "write records of files that could not be hashed here instead of into the list")
+	retryErrors := flag.Bool("retry-errors", false, "hash only the files recorded as failed in the list or -errors file")
 	progress := flag.Bool("progress", false, "show progress updates")
 	jsonl := flag.Bool("json", false, "output in JSONL format")
 	hkeyFlag := flag.String("hkey", defaultHighwayKey, "hex or base64 HighwayHash key")
-	algo := flag.String("hash", "sha1", "hash algorithm: md5|sha1|sha256|blake2b|blake3|xxhash|xxh3|xxh128|t1ha1|t1ha2|highway64|highway128|highway256|wyhash|rapidhash")
+	algo := flag.String("hash", "sha1", "hash algorithm: md5|sha1|sha256|sha512|blake2b|blake3|xxhash|xxh3|xxh128|t1ha1|t1ha2|highway64|highway128|highway256|wyhash|rapidhash")
+	info := flag.Bool("info", false, "print build info, CPU features and selected implementations")
+	splitMB := flag.Int64("split-mb", splitThreshold>>20, "hash blake3 files of at least this many MiB on all cores (0 disables)")
+	keyFlag := flag.String("key", "", "key for blake3, blake2b, sha256 (HMAC) and highway*: hex:V, base64:V, file:PATH or env:NAME")
+	seedFlag := flag.String("seed", "", "seed for xxhash, xxh3, xxh128, t1ha1, t1ha2, wyhash and rapidhash")
+	flag.DurationVar(&readTimeout, "read-timeout", 0, "fail a read that stalls longer than this, e.g. 30s (0 disables)")
+	flag.IntVar(&retries, "retries", 0, "hash a file again this many times after a transient error")
+	flag.DurationVar(&retryWait, "retry-wait", retryWait, "wait before the first retry, doubled for each further one")
+	signKey := flag.String("sign", "", "after generating, sign the list with this minisign, SSH ed25519 or raw Ed25519 secret key")
+	verifySig := flag.String("verify-sig", "", "before verifying, check the list's signature against this public key")
+	sigFile := flag.String("sig", "", "signature file for -sign and -verify-sig (default: the list with .minisig or .sig appended)")
+	flag.BoolVar(&xattrMode, "xattr", false, "keep checksums in user.checksum.* extended attributes of the files instead of a list (Linux)")
+	update := flag.Bool("update", false, "with -xattr or -db, hash files again that changed since they were hashed")
+	flag.BoolVar(&perDirMode, "per-dir", false, "write, or verify, a .checksums.<hash> manifest in every directory instead of a single list")
+	flag.StringVar(&catalogPath, "db", "", "keep checksums and their history in this SQLite catalog instead of a list")
+	flag.BoolVar(&merkleMode, "merkle", false, "record a hash for every directory; verify then compares directory by directory")
+	implFlag := flag.String("impl", "", "override implementations, e.g. sha256=go,blake3=c (also CHECKSUMFOLDER_IMPL)")
 	flag.Parse()
 
+	if err := applyImplOverrides(*implFlag); err != nil {
+		log.Fatal(err)
+	}
+	splitThreshold = *splitMB << 20
+
+	if *info {
+		printInfo(os.Stdout)
+		return
+	}
+
 	if k, err := hex.DecodeString(*hkeyFlag); err == nil {
 		if len(k) != 32 {
 			log.Fatal("highwayhash key must be 32 bytes")
@@ -70,52 +139,245 @@ func main() {
 		log.Fatal("invalid hkey encoding")
 	}
 
+	alg := strings.ToLower(*algo)
+	if *keyFlag != "" {
+		if _, ok := keyedAlgorithms[alg]; !ok {
+			log.Fatalf("-key is not supported by %s", alg)
+		}
+		k, src, err := loadKey(*keyFlag)
+		if err != nil {
+			log.Fatalf("-key: %v", err)
+		}
+		if err := checkKeyLen(alg, k); err != nil {
+			log.Fatal(err)
+		}
+		hashKey, keySource = k, src
+		if strings.HasPrefix(alg, "highway") {
+			highwayKey = k
+		}
+	}
+	if *seedFlag != "" {
+		if !seededAlgorithms[alg] {
+			log.Fatalf("-seed is not supported by %s", alg)
+		}
+		s, err := parseSeed(*seedFlag)
+		if err != nil {
+			log.Fatalf("-seed: %v", err)
+		}
+		hashSeed, seeded = s, true
+	}
+
+	ctx := signalContext()
+	var err error
+	if xattrMode {
+		if runtime.GOOS != "linux" {
+			log.Fatal("-xattr is only supported on Linux")
+		}
+		if hashKey != nil || seeded {
+			log.Fatal("-key and -seed cannot be used with -xattr")
+		}
+	}
+	if perDirMode && (hashKey != nil || seeded) {
+		log.Fatal("-key and -seed cannot be used with -per-dir")
+	}
+	// Manifests and the catalog record no backend, so they only take
+	// algorithms whose digests are the same in every build.
+	if perDirMode && digestsDiffer[strings.ToLower(*algo)] {
+		log.Fatalf("-hash %s cannot be used with -per-dir: its digests depend on the implementation in the build", *algo)
+	}
+	if catalogPath != "" && !catalogSupported {
+		log.Fatal(errNoCatalog)
+	}
+	if catalogPath != "" && (hashKey != nil || seeded) {
+		log.Fatal("-key and -seed cannot be used with -db")
+	}
+	if catalogPath != "" && digestsDiffer[strings.ToLower(*algo)] {
+		log.Fatalf("-hash %s cannot be used with -db: its digests depend on the implementation in the build", *algo)
+	}
 	if *verify {
-		if *list == "" {
+		if *list == "" && !xattrMode && !perDirMode && catalogPath == "" {
 			log.Fatal("-list required in verify mode")
 		}
-		if err := verifyChecksums(*dir, *list, *verbose, *progress, *jsonl, *algo); err != nil {
-			log.Fatal(err)
+		if *verifySig != "" {
+			signer, err := verifyListSig(*list, *verifySig, *sigFile)
+			if err != nil {
+				log.Fatalf("signature check failed: %v", err)
+			}
+			fmt.Fprintf(os.Stderr, "Good signature from %s\n", signer)
+		}
+		s := defaultShow(*verbose)
+		// These modes walk -dir anyway, so extra files cost nothing.
+		s[statusNotInList] = merkleMode || xattrMode || perDirMode || catalogPath != ""
+		if *showFlag != "" {
+			if s, err = parseShow(*showFlag); err != nil {
+				log.Fatalf("-show: %v", err)
+			}
+		}
+		var reps multiReporter
+		if *reportFile != "" {
+			rep, err := newReporter(*reportFile, *reportFormat)
+			if err != nil {
+				log.Fatalf("-report: %v", err)
+			}
+			reps = append(reps, rep)
+		}
+		if *htmlReport != "" {
+			rep, err := newHTMLReporter(*htmlReport, "verify", *dir, *list, *algo)
+			if err != nil {
+				log.Fatalf("-html-report: %v", err)
+			}
+			reps = append(reps, rep)
+		}
+		var rep reporter
+		if len(reps) > 0 {
+			rep = reps
+		}
+		if xattrMode {
+			err = verifyXattrs(ctx, *dir, s, *progress, rep)
+		} else if catalogPath != "" {
+			err = verifyCatalog(ctx, *dir, s, *progress, strings.ToLower(*algo), rep)
+		} else if perDirMode {
+			err = verifyPerDir(ctx, *dir, s, *progress, rep)
+		} else if merkleMode {
+			err = verifyMerkle(ctx, *dir, *list, s, *progress, *jsonl, *algo, rep)
+		} else {
+			err = verifyChecksums(ctx, *dir, *list, s, *verbose, *progress, *jsonl, *algo, rep)
 		}
 	} else {
-		if err := generateChecksums(*dir, *list, *progress, *jsonl, *algo); err != nil {
-			log.Fatal(err)
+		var rep reporter
+		if *htmlReport != "" {
+			if rep, err = newHTMLReporter(*htmlReport, "generate", *dir, *list, *algo); err != nil {
+				log.Fatalf("-html-report: %v", err)
+			}
+		}
+		if *signKey != "" && *list == "" {
+			log.Fatal("-sign needs -list")
+		}
+		if xattrMode {
+			err = generateXattrs(ctx, *dir, *update, *progress, strings.ToLower(*algo), rep)
+		} else if catalogPath != "" {
+			err = generateCatalog(ctx, *dir, *update, *progress, strings.ToLower(*algo), rep)
+		} else if perDirMode {
+			err = generatePerDir(ctx, *dir, *progress, strings.ToLower(*algo), rep)
+		} else {
+			err = generateChecksums(ctx, *dir, *list, *errorsFile, *retryErrors, *progress, *jsonl, *algo, rep)
+		}
+		if err == nil && *signKey != "" {
+			var sigPath string
+			if sigPath, err = signList(*list, *signKey, *sigFile); err == nil {
+				fmt.Fprintf(os.Stderr, "Signature written to %s\n", sigPath)
+			}
+		}
+	}
+	if errors.Is(err, errInterrupted) {
+		os.Exit(130)
+	}
+	if errors.Is(err, errCorrupted) {
+		os.Exit(exitCorrupted)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// signalContext returns a context cancelled by the first SIGINT or SIGTERM.
+// Runs then stop dispatching new files and let the workers finish;
+// restoring the default handlers means a second signal terminates
+// immediately.
+func signalContext() context.Context {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	return ctx
+}
+
+// dispatch sends paths to jobs until all are sent or ctx is cancelled and
+// returns how many were sent.
+func dispatch(ctx context.Context, jobs chan<- string, paths []string) int {
+	for i, p := range paths {
+		if ctx.Err() != nil {
+			return i
+		}
+		select {
+		case jobs <- p:
+		case <-ctx.Done():
+			return i
 		}
 	}
+	return len(paths)
 }
 
-func generateChecksums(dir, output string, progress, jsonOut bool, algo string) error {
-        start := time.Now()
-        processed := map[string]bool{}
+// walkEntries calls fn for every entry under dir, dir itself included, in
+// lexical order. It stops with errInterrupted once ctx is cancelled.
+func walkEntries(ctx context.Context, dir string, fn func(path string, d os.DirEntry) error) error {
+	return filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return errInterrupted
+		}
+		return fn(path, d)
+	})
+}
+
+// scanList records the paths a list already has a checksum for in done and
+// those it has an error record for in failed. A missing list is not an
+// error.
+func scanList(path string, jsonIn bool, done, failed map[string]bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if r, ok := parseErrorRecord(line, jsonIn); ok {
+			failed[r.Path] = true
+			continue
+		}
+		if e, ok := parseListLine(line, jsonIn); ok {
+			done[e.path] = true
+		}
+	}
+}
+
+func generateChecksums(ctx context.Context, dir, output, errorsFile string, retryErrors, progress, jsonOut bool, algo string, rep reporter) error {
+	report := newGenerateReport(rep)
+	processed := map[string]bool{}
+	failed := map[string]bool{}
 	toFile := output != ""
 	var file *os.File
 	var writer *bufio.Writer
 	const flushInterval = 100
-	var lineCount int
+	var lineCount, errCount int
 	mu := sync.Mutex{}
 	var err error
+	// With -merkle the file hashes, including those of a resumed list, are
+	// kept to derive the directory hashes once every file is done.
+	var hashes map[string]string
+	if merkleMode {
+		hashes = map[string]string{}
+	}
 
 	if toFile {
-		if f, err := os.Open(output); err == nil {
-			scanner := bufio.NewScanner(f)
-			for scanner.Scan() {
-				line := scanner.Text()
-				if jsonOut {
-					var e struct {
-						Hash string `json:"hash"`
-						Path string `json:"path"`
-					}
-					if err := json.Unmarshal([]byte(line), &e); err == nil {
-						processed[e.Path] = true
-					}
-				} else {
-					parts := strings.SplitN(line, "\t", 2)
-					if len(parts) == 2 {
-						processed[parts[1]] = true
-					}
-				}
+		if h, ok, err := readListHeader(output, jsonOut); err == nil && ok {
+			if err := checkKeying(h); err != nil {
+				return fmt.Errorf("%s: %w", output, err)
+			}
+			if err := checkBackend(h); err != nil {
+				return fmt.Errorf("%s: %w", output, err)
+			}
+		}
+		scanList(output, jsonOut, processed, failed)
+		if merkleMode {
+			entries, _ := readList(output, jsonOut)
+			for _, e := range entries {
+				hashes[e.path] = e.hash
 			}
-			f.Close()
 		}
 
 		file, err = os.OpenFile(output, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
@@ -123,6 +385,12 @@ func generateChecksums(dir, output string, progress, jsonOut bool, algo string)
 			return err
 		}
 		writer = bufio.NewWriterSize(file, 64*1024)
+		if fi, err := file.Stat(); err == nil && fi.Size() == 0 {
+			if err := newListHeader(algo).writeTo(writer, jsonOut); err != nil {
+				file.Close()
+				return err
+			}
+		}
 		defer func() {
 			mu.Lock()
 			writer.Flush()
@@ -139,42 +407,104 @@ func generateChecksums(dir, output string, progress, jsonOut bool, algo string)
 			mu.Unlock()
 		}()
 	}
-	var paths []string
-	err = filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+
+	// Failures go to the -errors sidecar when given, otherwise into the list
+	// itself next to the checksums.
+	errWriter := writer
+	if errorsFile != "" {
+		scanList(errorsFile, jsonOut, processed, failed)
+		ef, err := os.OpenFile(errorsFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
 		if err != nil {
 			return err
 		}
-		if !d.IsDir() && !processed[path] {
-			paths = append(paths, path)
+		errWriter = bufio.NewWriter(ef)
+		defer func() {
+			mu.Lock()
+			errWriter.Flush()
+			ef.Sync()
+			ef.Close()
+			mu.Unlock()
+		}()
+	}
+	if retryErrors && !toFile && errorsFile == "" {
+		return errors.New("-retry-errors needs -list or -errors to read the failures from")
+	}
+
+	var paths []string
+	sizes := map[string]int64{}
+	if retryErrors {
+		// Re-attempt only the recorded failures that have not succeeded
+		// since.
+		for p := range failed {
+			if !processed[p] {
+				paths = append(paths, p)
+			}
 		}
-		return nil
-	})
+		slices.Sort(paths)
+		if progress {
+			for _, p := range paths {
+				if fi, err := os.Stat(p); err == nil {
+					sizes[p] = fi.Size()
+				} else {
+					sizes[p] = 0
+				}
+			}
+		}
+	} else {
+		err = walkEntries(ctx, dir, func(path string, d os.DirEntry) error {
+			if !d.IsDir() && !processed[path] && !failed[path] {
+				paths = append(paths, path)
+				if progress {
+					if fi, err := d.Info(); err == nil {
+						sizes[path] = fi.Size()
+					} else {
+						sizes[path] = 0
+					}
+				}
+			}
+			return nil
+		})
+	}
+	if err == errInterrupted {
+		fmt.Fprintf(os.Stderr, "Interrupted while scanning %s, nothing hashed\n", dir)
+	}
 	if err != nil {
 		return err
 	}
-	total := len(paths)
-	var processedCount int64
 
 	jobs := make(chan string)
 	wg := sync.WaitGroup{}
 	workers := runtime.NumCPU()
+	meter := newProgressMeter(progress, len(paths), sizes, workers)
 	for i := 0; i < workers; i++ {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
 			for path := range jobs {
-				hash, err := hashFile(path, algo)
+				fileStart := time.Now()
+				// The size and mtime recorded must describe the file that
+				// was hashed, so they are taken first and checked after.
+				fi, err := os.Stat(path)
+				var hash string
+				if err == nil {
+					hash, err = hashWithRetry(ctx, path, algo, meter.begin(i, path))
+				}
+				if now, serr := os.Stat(path); err == nil && (serr != nil || !unchanged(fi, now)) {
+					err = &fs.PathError{Op: "read", Path: path, Err: errUnstable}
+				}
+				report.add(path, hash, err, fileStart)
 				if err != nil {
 					log.Printf("%v", err)
+					mu.Lock()
+					errWriter.WriteString(formatErrorRecord(path, err, jsonOut))
+					errCount++
+					mu.Unlock()
 				} else {
-					var line string
-					if jsonOut {
-						b, _ := json.Marshal(map[string]string{"hash": hash, "path": path})
-						line = string(b) + "\n"
-					} else {
-						line = fmt.Sprintf("%s\t%s\n", hash, path)
-					}
+					line := formatListLine(hash, path, fi, jsonOut)
 					mu.Lock()
+					if hashes != nil {
+						hashes[path] = hash
+					}
 					if _, err := writer.WriteString(line); err == nil {
 						lineCount++
 						if lineCount%flushInterval == 0 {
@@ -186,79 +516,78 @@ func generateChecksums(dir, output string, progress, jsonOut bool, algo string)
 					}
 					mu.Unlock()
 				}
-				atomic.AddInt64(&processedCount, 1)
+				meter.end(i)
 			}
 		}()
 	}
 
-	var ticker *time.Ticker
-	if progress && total > 0 {
-		ticker = time.NewTicker(time.Second)
-		go func() {
-			for range ticker.C {
-				fmt.Printf("%d/%d\n", atomic.LoadInt64(&processedCount), total)
-			}
-		}()
-	}
-
-	for _, p := range paths {
-		jobs <- p
-	}
+	meter.run()
+	sent := dispatch(ctx, jobs, paths)
 	close(jobs)
 	wg.Wait()
 	mu.Lock()
+	if hashes != nil && sent == len(paths) {
+		root := writeDirRecords(writer, dir, output, hashes, jsonOut)
+		fmt.Fprintf(os.Stderr, "Merkle root: %s\n", root)
+	}
 	writer.Flush()
 	if toFile {
 		file.Sync()
 	}
+	if errWriter != writer {
+		errWriter.Flush()
+	}
 	mu.Unlock()
-        if ticker != nil {
-                ticker.Stop()
-                fmt.Printf("%d/%d\n", processedCount, total)
-        }
-        if progress {
-                fmt.Printf("Time elapsed: %s\n", time.Since(start).Round(time.Second))
-        }
-        return nil
+	meter.finish()
+	if err := report.close(len(paths)); err != nil {
+		return err
+	}
+	if errCount > 0 {
+		where := "the output"
+		switch {
+		case errorsFile != "":
+			where = errorsFile
+		case toFile:
+			where = output
+		}
+		fmt.Fprintf(os.Stderr, "%d files could not be hashed, recorded in %s; rerun with -retry-errors to retry them\n", errCount, where)
+	}
+	if sent < len(paths) {
+		fmt.Fprintf(os.Stderr, "Interrupted: processed %d of %d files, %d not started\n", sent, len(paths), len(paths)-sent)
+		if toFile {
+			fmt.Fprintf(os.Stderr, "Run the same command again to resume from %s\n", output)
+		}
+		return errInterrupted
+	}
+	return nil
 }
 
-func verifyChecksums(dir, listfile string, verbose, progress, jsonIn bool, algo string) error {
-        start := time.Now()
-        type entry struct {
-                hash string
-                path string
-        }
-	var entries []entry
+func verifyChecksums(ctx context.Context, dir, listfile string, show statusSet, verbose, progress, jsonIn bool, algo string, rep reporter) error {
+	col := newVerifyCollector(show, rep)
+	if h, ok, err := readListHeader(listfile, jsonIn); err != nil {
+		return err
+	} else if ok {
+		if err := checkKeying(h); err != nil {
+			return fmt.Errorf("%s: %w", listfile, err)
+		}
+		if err := checkBackend(h); err != nil {
+			return fmt.Errorf("%s: %w", listfile, err)
+		}
+	}
 
-	f, err := os.Open(listfile)
+	var entries []listEntry
+	var err error
+	if isHashdeepList(listfile) {
+		entries, err = hashdeepListEntries(listfile, strings.ToLower(algo))
+	} else {
+		entries, err = readList(listfile, jsonIn)
+	}
 	if err != nil {
 		return err
 	}
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if jsonIn {
-			var e struct {
-				Hash string `json:"hash"`
-				Path string `json:"path"`
-			}
-			if err := json.Unmarshal([]byte(line), &e); err == nil {
-				p := strings.ReplaceAll(e.Path, "\\", "/")
-				entries = append(entries, entry{hash: e.Hash, path: p})
-			}
-		} else {
-			parts := strings.SplitN(line, "\t", 2)
-			if len(parts) == 2 {
-				// Normalize all backslashes to forward slashes.
-				// This is crucial for consistent parsing of paths from Windows.
-				p := strings.ReplaceAll(parts[1], "\\", "/")
-				entries = append(entries, entry{hash: parts[0], path: p})
-			}
-		}
-	}
-	f.Close()
 
 	expected := map[string]string{}
+	recorded := map[string]listEntry{}
 	var pathsToProcess []string
 
 	// Get the absolute path of the -dir argument
@@ -270,92 +599,82 @@ func verifyChecksums(dir, listfile string, verbose, progress, jsonIn bool, algo
 	absDir = filepath.Clean(absDir)
 
 	for _, e := range entries {
-		var actualPath string
-		// Check if the path from the list file starts with a Windows drive letter (e.g., "H:/")
-		isWindowsDrivePath := len(e.path) >= 2 && e.path[1] == ':' && (e.path[0] >= 'A' && e.path[0] <= 'Z' || e.path[0] >= 'a' && e.path[0] <= 'z')
-
-		if isWindowsDrivePath {
-			// If it's a Windows drive path, strip the drive letter and leading slash/backslash
-			// and treat the rest as relative to the -dir.
-			tempPath := e.path[2:]
-			if strings.HasPrefix(tempPath, "/") || strings.HasPrefix(tempPath, "\\") {
-				tempPath = tempPath[1:]
-			}
-			// Now tempPath is like "_YD_Photo/Фото и видео/..."
-			// Apply the dirBase trimming logic to tempPath
-			dirBase := filepath.Base(absDir)
-			if dirBase != "" && strings.HasPrefix(tempPath, dirBase+"/") {
-				actualPath = filepath.Join(absDir, strings.TrimPrefix(tempPath, dirBase+"/"))
-			} else {
-				actualPath = filepath.Join(absDir, tempPath)
-			}
-		} else if filepath.IsAbs(e.path) {
-			// If it's a Unix-style absolute path (starts with /), use it directly.
-			// This assumes the absolute path is valid on the current system.
-			actualPath = e.path
-		} else {
-			// It's a relative path (e.g., "_YD_Photo/..." or "subfolder/...")
-			// Join it with the absolute -dir.
-			// We still need the logic to trim dirBase if present in e.path.
-			dirBase := filepath.Base(absDir)
-			if dirBase != "" && strings.HasPrefix(e.path, dirBase+"/") {
-				actualPath = filepath.Join(absDir, strings.TrimPrefix(e.path, dirBase+"/"))
-			} else {
-				actualPath = filepath.Join(absDir, e.path)
-			}
-		}
+		actualPath := resolveListPath(absDir, e.path)
 		expected[actualPath] = e.hash
+		recorded[actualPath] = e
 		pathsToProcess = append(pathsToProcess, actualPath)
 	}
 
-	var match, mismatch int
 	total := len(pathsToProcess)
-	var processedCount int64
+	sizes := map[string]int64{}
+	if progress {
+		for _, p := range pathsToProcess {
+			if fi, err := os.Stat(p); err == nil {
+				sizes[p] = fi.Size()
+			} else {
+				sizes[p] = 0
+			}
+		}
+	}
 
-	type result struct {
-		path   string
-		status string
-		ok     bool
+	// Files under -dir the list does not mention are only looked for when
+	// asked, as lists often cover just part of a tree.
+	var extra []string
+	if show[statusNotInList] {
+		absList, _ := filepath.Abs(listfile)
+		err := filepath.WalkDir(absDir, func(path string, d os.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if ctx.Err() != nil {
+				return errInterrupted
+			}
+			if _, ok := expected[path]; !ok && !d.IsDir() && path != absList {
+				extra = append(extra, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
 	}
 
 	jobs := make(chan string)
 	workers := runtime.NumCPU()
-	results := make(chan result, workers)
+	results := make(chan fileResult, workers)
 	done := make(chan struct{})
 	wg := sync.WaitGroup{}
+	meter := newProgressMeter(progress, total, sizes, workers)
 	for i := 0; i < workers; i++ {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
 			for path := range jobs { // 'path' here is the actual path to hash
-				exp, ok := expected[path] // Lookup using the actual path
-				hash, hErr := hashFile(path, algo)
-				r := result{path: path}
-				if hErr != nil {
-					r.status = hErr.Error()
-					fmt.Printf("ERROR: %s: %v\n", path, hErr) // Add this line
-				} else if !ok || exp != hash {
-					r.status = "MISMATCH"
-				} else {
-					r.status = "OK"
-					r.ok = true
+				start := time.Now()
+				hash, hErr := hashWithRetry(ctx, path, algo, meter.begin(i, path))
+				r := fileResult{
+					path:     path,
+					expected: expected[path],
+					actual:   hash,
+					status:   statusOf(hErr, expected[path], hash),
+					duration: time.Since(start),
+					err:      hErr,
+				}
+				if fi, err := os.Stat(path); err == nil {
+					r.size = fi.Size()
+					if e := recorded[path]; r.status == statusMismatch && e.stat {
+						r.status = classifyMismatch(e.size, e.mtime, fi)
+					}
 				}
+				meter.end(i)
 				results <- r
-				atomic.AddInt64(&processedCount, 1)
 			}
 		}()
 	}
 
 	go func() {
 		for r := range results {
-			if r.ok {
-				match++
-			} else {
-				mismatch++
-			}
-			if verbose || r.status == "MISMATCH" || (r.status == "OK" && !r.ok) {
-				fmt.Printf("%s %s\n", r.path, r.status)
-			}
+			col.add(r)
 		}
 		done <- struct{}{}
 	}()
@@ -365,61 +684,123 @@ func verifyChecksums(dir, listfile string, verbose, progress, jsonIn bool, algo
 		close(results)
 	}()
 
-	var ticker *time.Ticker
-	if progress && total > 0 {
-		ticker = time.NewTicker(time.Second)
-		go func() {
-			for range ticker.C {
-				fmt.Printf("%d/%d\n", atomic.LoadInt64(&processedCount), total)
-			}
-		}()
+	meter.run()
+	sent := dispatch(ctx, jobs, pathsToProcess)
+	close(jobs)
+	wg.Wait()
+	meter.finish()
+
+	<-done
+	for _, p := range extra {
+		r := fileResult{path: p, status: statusNotInList}
+		if fi, err := os.Stat(p); err == nil {
+			r.size = fi.Size()
+		}
+		col.add(r)
 	}
 
-	for _, p := range pathsToProcess { // Send actual paths to jobs channel
-		jobs <- p
+	match := "All files match"
+	if verbose {
+		match = ""
 	}
-	close(jobs)
-	wg.Wait()
-	if ticker != nil {
-		ticker.Stop()
-		fmt.Printf("%d/%d\n", processedCount, total)
+	col.summarize(total, match)
+	err = col.close(total)
+	if sent < total && (err == nil || err == errCorrupted) {
+		fmt.Fprintf(os.Stderr, "Interrupted: verified %d of %d files, %d not checked\n", sent, total, total-sent)
+		return errInterrupted
 	}
+	return err
+}
 
-	<-done
+// hashFile returns the hex digest of path. If read is not nil the bytes
+// read are added to it as hashing progresses. It fails with errUnstable if
+// the size or modification time of the file changed while it was read.
+func hashFile(path, algo string, read *atomic.Int64) (string, error) {
+	var sum string
+	err := readStable(path, read, func(f *os.File, r io.Reader) (err error) {
+		sum, err = hashReader(f, r, algo, read)
+		return err
+	})
+	return sum, err
+}
 
-	if !verbose {
-		if mismatch == 0 {
-			fmt.Println("All files match")
+// hashFileMulti hashes path with every algorithm in algos while reading it
+// once. algos must be algorithms newDigest knows.
+func hashFileMulti(path string, algos []string, read *atomic.Int64) (map[string]string, error) {
+	hs := make([]hash.Hash, len(algos))
+	ws := make([]io.Writer, len(algos))
+	for i, a := range algos {
+		h, err := newDigest(a)
+		if err != nil {
+			return nil, err
 		}
+		hs[i], ws[i] = h, h
 	}
-        fmt.Printf("Total:%d Match:%d Mismatch:%d\n", total, match, mismatch)
-        if progress {
-                fmt.Printf("Time elapsed: %s\n", time.Since(start).Round(time.Second))
-        }
-        return nil
+	err := readStable(path, read, func(_ *os.File, r io.Reader) error {
+		_, err := io.Copy(io.MultiWriter(ws...), r)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	sums := make(map[string]string, len(algos))
+	for i, a := range algos {
+		sums[a] = hex.EncodeToString(hs[i].Sum(nil))
+	}
+	return sums, nil
 }
 
-func hashFile(path, algo string) (string, error) {
+// readStable opens path and passes it to fn, together with a reader that
+// applies -read-timeout and counts into read. It fails with errUnstable if
+// the file changed while fn read it.
+func readStable(path string, read *atomic.Int64, fn func(f *os.File, r io.Reader) error) error {
 	f, err := os.Open(path)
 	if err != nil {
-		return "", err
+		return err
 	}
 	defer f.Close()
+	before, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	r := newTimeoutReader(f)
+	if read != nil {
+		r = countingReader{r, read}
+	}
+	err = fn(f, r)
+	if errors.Is(err, errReadTimeout) {
+		return &fs.PathError{Op: "read", Path: path, Err: err}
+	}
+	if err != nil {
+		return err
+	}
+	if after, err := os.Stat(path); err != nil || !unchanged(before, after) {
+		return &fs.PathError{Op: "read", Path: path, Err: errUnstable}
+	}
+	return nil
+}
+
+// hashReader hashes the contents of f read through r. f is used directly
+// only where the algorithm reads it in parallel.
+func hashReader(f *os.File, r io.Reader, algo string, read *atomic.Int64) (string, error) {
 	alg := strings.ToLower(algo)
 
 	if alg == "xxh128" {
 		h := xxh3.New()
-		if _, err := io.Copy(h, f); err != nil {
+		if seeded {
+			h = xxh3.NewSeed(hashSeed)
+		}
+		if _, err := io.Copy(h, r); err != nil {
 			return "", err
 		}
 		sum := h.Sum128().Bytes()
 		return hex.EncodeToString(sum[:]), nil
 	} else if alg == "t1ha2" {
-		b, err := io.ReadAll(f)
+		b, err := io.ReadAll(r)
 		if err != nil {
 			return "", err
 		}
-		lo, hi := t1ha.Sum128(b, 0)
+		lo, hi := t1ha.Sum128(b, hashSeed)
 		sum := make([]byte, 16)
 		binary.BigEndian.PutUint64(sum[:8], hi)
 		binary.BigEndian.PutUint64(sum[8:], lo)
@@ -428,52 +809,83 @@ func hashFile(path, algo string) (string, error) {
 
 	var h hash.Hash
 	switch alg {
-	case "md5":
-		h = md5.New()
-	case "sha1":
-		h = sha1.New()
-	case "sha256":
-		if useStdSHA256 {
-			h = stdsha256.New()
-		} else {
-			h = sha256.New()
+	case "md5", "sha1", "sha256", "sha512", "blake2b":
+		d, err := newDigest(alg)
+		if err != nil {
+			return "", err
 		}
-	case "blake2b":
-		h = blake2b.New512()
+		h = d
 	case "blake3":
-		if useBlake3C {
-			ch := blake3c.BLAKE3Init()
-			if _, err := io.Copy(ch, f); err != nil {
+		if impl[alg] == "c" {
+			if fi, err := f.Stat(); err == nil && splitThreshold > 0 && fi.Size() >= splitThreshold {
+				sum, err := hashBlake3Split(f, fi.Size(), read)
+				if err != nil {
+					return "", err
+				}
+				return hex.EncodeToString(sum), nil
+			}
+			ch := newBlake3C()
+			if _, err := io.Copy(ch, r); err != nil {
 				return "", err
 			}
 			return hex.EncodeToString(ch.Sum(nil)), nil
 		}
-		h = blake3.New()
+		if hashKey != nil {
+			kh, err := blake3.NewKeyed(hashKey)
+			if err != nil {
+				return "", err
+			}
+			h = kh
+		} else {
+			h = blake3.New()
+		}
 	case "xxhash":
-		h = xxhash.New()
+		if seeded {
+			h = xxhash.NewWithSeed(hashSeed)
+		} else {
+			h = xxhash.New()
+		}
 	case "xxh3":
-		h = xxh3.New()
+		if seeded {
+			h = xxh3.NewSeed(hashSeed)
+		} else {
+			h = xxh3.New()
+		}
 	case "t1ha1":
 		// t1ha1 processes a byte slice entirely in memory
-		b, err := io.ReadAll(f)
+		b, err := io.ReadAll(r)
 		if err != nil {
 			return "", err
 		}
-		sum := t1ha.Sum64(b, 0)
+		sum64 := t1ha.Sum64
+		if impl[alg] == "go" {
+			sum64 = t1ha.Sum64Go
+		}
+		sum := sum64(b, hashSeed)
 		return fmt.Sprintf("%016x", sum), nil
 	case "wyhash":
-		b, err := io.ReadAll(f)
+		b, err := io.ReadAll(r)
 		if err != nil {
 			return "", err
 		}
-		sum := wyhashc.Sum64(b)
+		var sum uint64
+		if seeded {
+			sum = wyhashc.Sum64Seed(b, hashSeed)
+		} else {
+			sum = wyhashc.Sum64(b)
+		}
 		return fmt.Sprintf("%016x", sum), nil
 	case "rapidhash":
-		b, err := io.ReadAll(f)
+		b, err := io.ReadAll(r)
 		if err != nil {
 			return "", err
 		}
-		sum := rapidhashc.Sum64(b)
+		var sum uint64
+		if seeded {
+			sum = rapidhashc.Sum64Seed(b, hashSeed)
+		} else {
+			sum = rapidhashc.Sum64(b)
+		}
 		return fmt.Sprintf("%016x", sum), nil
 	case "highway64":
 		hw, err := highwayhash.New64(highwayKey)
@@ -496,8 +908,36 @@ func hashFile(path, algo string) (string, error) {
 	default:
 		return "", fmt.Errorf("unknown hash algorithm: %s", algo)
 	}
-	if _, err := io.Copy(h, f); err != nil {
+	if _, err := io.Copy(h, r); err != nil {
 		return "", err
 	}
 	return hex.EncodeToString(h.Sum(nil)), nil
 }
+
+// newDigest returns a streaming hash for the algorithms whose digest is a
+// plain hash.Hash sum, honouring -key and -impl.
+func newDigest(alg string) (hash.Hash, error) {
+	switch alg {
+	case "md5":
+		return md5.New(), nil
+	case "sha1":
+		return sha1.New(), nil
+	case "sha256":
+		newSHA256 := sha256.New
+		if impl[alg] == "go" {
+			newSHA256 = stdsha256.New
+		}
+		if hashKey != nil {
+			return hmac.New(newSHA256, hashKey), nil
+		}
+		return newSHA256(), nil
+	case "sha512":
+		return sha512.New(), nil
+	case "blake2b":
+		if hashKey != nil {
+			return blake2b.New(&blake2b.Config{Key: hashKey})
+		}
+		return blake2b.New512(), nil
+	}
+	return nil, fmt.Errorf("unknown hash algorithm: %s", alg)
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"iter"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// merkleMode makes generate append a hash for every directory and verify
+// compare trees directory by directory.
+var merkleMode bool
+
+// dirRecordPrefix starts a text directory record,
+// "# dir<TAB>hash<TAB>path". Like error records it begins with '#' so
+// readers that only want checksums skip it.
+const dirRecordPrefix = "# dir\t"
+
+// dirRecord is the JSONL form of a directory hash.
+type dirRecord struct {
+	Hash string `json:"dir"`
+	Path string `json:"path"`
+}
+
+func formatDirRecord(path, hash string, jsonOut bool) string {
+	if jsonOut {
+		b, _ := json.Marshal(dirRecord{Hash: hash, Path: path})
+		return string(b) + "\n"
+	}
+	return fmt.Sprintf("%s%s\t%s\n", dirRecordPrefix, hash, path)
+}
+
+// parseDirRecord reports whether line is a directory record and returns it.
+func parseDirRecord(line string, jsonIn bool) (dirRecord, bool) {
+	var r dirRecord
+	if jsonIn {
+		if !strings.HasPrefix(line, `{"dir":`) {
+			return r, false
+		}
+		if json.Unmarshal([]byte(line), &r) != nil || r.Hash == "" {
+			return r, false
+		}
+		return r, true
+	}
+	rest, ok := strings.CutPrefix(line, dirRecordPrefix)
+	if !ok {
+		return r, false
+	}
+	r.Hash, r.Path, ok = strings.Cut(rest, "\t")
+	return r, ok
+}
+
+// readDirRecords returns the directory hashes of a list by path. A later
+// record for the same directory replaces an earlier one, so a resumed run
+// that appended new records wins.
+func readDirRecords(listfile string, jsonIn bool) (map[string]string, error) {
+	f, err := os.Open(listfile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	dirs := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if r, ok := parseDirRecord(scanner.Text(), jsonIn); ok {
+			dirs[strings.ReplaceAll(r.Path, "\\", "/")] = r.Hash
+		}
+	}
+	return dirs, scanner.Err()
+}
+
+// merkleHashes computes the hash of every directory that contains files,
+// given the file hashes keyed by slash-separated path relative to the root,
+// which is ".". A directory hash is the SHA-256 of its entries sorted by
+// name, each written as "f" or "d", the name, a NUL, the entry's hash and a
+// newline, so a change anywhere below a directory changes it and every
+// directory above it.
+func merkleHashes(files map[string]string) map[string]string {
+	kids := childIndex(maps.Keys(files))
+	dirs := map[string]string{}
+	var hashDir func(d string) string
+	hashDir = func(d string) string {
+		h := sha256.New()
+		for _, c := range kids[d] {
+			name := path.Base(c)
+			if _, isDir := kids[c]; isDir {
+				fmt.Fprintf(h, "d%s\x00%s\n", name, hashDir(c))
+			} else {
+				fmt.Fprintf(h, "f%s\x00%s\n", name, files[c])
+			}
+		}
+		sum := hex.EncodeToString(h.Sum(nil))
+		dirs[d] = sum
+		return sum
+	}
+	if len(files) > 0 {
+		hashDir(".")
+	}
+	return dirs
+}
+
+// childIndex maps every directory above the given relative paths to its
+// direct entries, sorted.
+func childIndex(paths ...iter.Seq[string]) map[string][]string {
+	seen := map[string]bool{}
+	kids := map[string][]string{}
+	for _, seq := range paths {
+		for p := range seq {
+			for p != "." && !seen[p] {
+				seen[p] = true
+				parent := path.Dir(p)
+				kids[parent] = append(kids[parent], p)
+				p = parent
+			}
+		}
+	}
+	for _, c := range kids {
+		slices.Sort(c)
+	}
+	return kids
+}
+
+// writeDirRecords appends a record for every directory under dir to w and
+// returns the root hash. hashes maps the list paths of the files to their
+// checksums; skip, usually the list itself, is left out.
+func writeDirRecords(w io.Writer, dir, skip string, hashes map[string]string, jsonOut bool) string {
+	absSkip, _ := filepath.Abs(skip)
+	files := map[string]string{}
+	for p, h := range hashes {
+		if abs, _ := filepath.Abs(p); skip != "" && abs == absSkip {
+			continue
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		files[filepath.ToSlash(rel)] = h
+	}
+	dirs := merkleHashes(files)
+	for _, d := range sortedKeys(dirs) {
+		io.WriteString(w, formatDirRecord(filepath.Join(dir, d), dirs[d], jsonOut))
+	}
+	return dirs["."]
+}
+
+// verifyMerkle verifies dir against a list written with -merkle. Every file
+// under dir is hashed and the directory hashes are compared from the root
+// down: a directory whose hash matches is accepted as a whole, and only
+// directories that differ are opened to find the files responsible.
+func verifyMerkle(ctx context.Context, dir, listfile string, show statusSet, progress, jsonIn bool, algo string, rep reporter) error {
+	col := newVerifyCollector(show, rep)
+	if h, ok, err := readListHeader(listfile, jsonIn); err != nil {
+		return err
+	} else if ok {
+		if err := checkKeying(h); err != nil {
+			return fmt.Errorf("%s: %w", listfile, err)
+		}
+		if err := checkBackend(h); err != nil {
+			return fmt.Errorf("%s: %w", listfile, err)
+		}
+	}
+	entries, err := readList(listfile, jsonIn)
+	if err != nil {
+		return err
+	}
+	recorded, err := readDirRecords(listfile, jsonIn)
+	if err != nil {
+		return err
+	}
+	if len(recorded) == 0 {
+		return fmt.Errorf("%s has no directory hashes; generate it with -merkle", listfile)
+	}
+
+	// The root is the directory the list was generated for, which has the
+	// shortest path of all directory records.
+	root := ""
+	for p := range recorded {
+		if root == "" || len(p) < len(root) || len(p) == len(root) && p < root {
+			root = p
+		}
+	}
+	relTo := func(p string) (string, bool) {
+		rel, err := filepath.Rel(root, p)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			return "", false
+		}
+		return filepath.ToSlash(rel), true
+	}
+	listedDirs := map[string]string{}
+	for p, h := range recorded {
+		if rel, ok := relTo(p); ok {
+			listedDirs[rel] = h
+		}
+	}
+	listed := map[string]string{}
+	stats := map[string]listEntry{}
+	for _, e := range entries {
+		if rel, ok := relTo(e.path); ok {
+			listed[rel] = e.hash
+			stats[rel] = e
+		}
+	}
+
+	infos, err := walkTree(ctx, dir)
+	if err != nil {
+		return err
+	}
+	absDir, _ := filepath.Abs(dir)
+	absList, _ := filepath.Abs(listfile)
+	if rel, err := filepath.Rel(absDir, absList); err == nil {
+		delete(infos, filepath.ToSlash(rel))
+		delete(listed, filepath.ToSlash(rel))
+	}
+	paths := make([]string, 0, len(infos))
+	for rel := range infos {
+		paths = append(paths, filepath.Join(dir, rel))
+	}
+	var errMu sync.Mutex
+	failures := map[string]error{}
+	sums, err := hashAll(ctx, paths, func(p string, read *atomic.Int64) (string, error) {
+		h, err := hashWithRetry(ctx, p, algo, read)
+		if err != nil {
+			errMu.Lock()
+			failures[p] = err
+			errMu.Unlock()
+		}
+		return h, err
+	}, progress)
+	if err != nil {
+		return err
+	}
+	live := map[string]string{}
+	for rel := range infos {
+		if h, ok := sums[filepath.Join(dir, rel)]; ok {
+			live[rel] = h
+		}
+	}
+	liveDirs := merkleHashes(live)
+	kids := childIndex(maps.Keys(listed), maps.Keys(infos))
+
+	changed := 0
+	report := func(rel string, status verifyStatus, err error) {
+		r := fileResult{path: filepath.Join(dir, rel), expected: listed[rel], actual: live[rel], status: status, err: err}
+		if fi, ok := infos[rel]; ok {
+			r.size = fi.Size()
+		}
+		col.add(r)
+	}
+	// accept counts every listed file below a matching directory as OK.
+	var accept func(d string)
+	accept = func(d string) {
+		for _, c := range kids[d] {
+			if _, ok := listed[c]; ok {
+				report(c, statusOK, nil)
+			}
+			accept(c)
+		}
+	}
+	var descend func(d string)
+	descend = func(d string) {
+		if h, ok := listedDirs[d]; ok && h == liveDirs[d] {
+			accept(d)
+			return
+		}
+		changed++
+		fmt.Printf("%s%c CHANGED\n", filepath.Join(dir, d), filepath.Separator)
+		for _, c := range kids[d] {
+			want, inList := listed[c]
+			_, exists := infos[c]
+			switch {
+			case !inList && exists:
+				report(c, statusNotInList, nil)
+			case inList && !exists:
+				report(c, statusMissing, nil)
+			case inList:
+				if got, ok := live[c]; ok {
+					status := statusOf(nil, want, got)
+					if e := stats[c]; status == statusMismatch && e.stat {
+						status = classifyMismatch(e.size, e.mtime, infos[c])
+					}
+					report(c, status, nil)
+				} else {
+					err := failures[filepath.Join(dir, c)]
+					report(c, statusOf(err, want, ""), err)
+				}
+			}
+			if _, ok := kids[c]; ok {
+				descend(c)
+			}
+		}
+	}
+	descend(".")
+
+	if changed == 0 {
+		fmt.Printf("Merkle root matches: %s\n", liveDirs["."])
+	} else {
+		fmt.Printf("Merkle root differs: list %s, now %s; %d directories changed\n", listedDirs["."], liveDirs["."], changed)
+	}
+	col.summarize(len(listed), "")
+	return col.close(len(listed))
+}
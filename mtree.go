@@ -0,0 +1,611 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// mtreeAlgorithms lists the mtree digests the hash engine can compute. The
+// keyword of each is the name followed by "digest"; specs may also use the
+// bare name.
+var mtreeAlgorithms = []string{"md5", "sha1", "sha256", "sha512"}
+
+// mtreeOrder is the order keywords are written in.
+var mtreeOrder = []string{"type", "mode", "uid", "gid", "nlink", "size", "time", "link",
+	"md5digest", "sha1digest", "sha256digest", "sha512digest"}
+
+// mtreeContent are the keywords describing what a file holds. A difference
+// in any other checked keyword is a metadata change.
+var mtreeContent = []string{"type", "size", "link", "md5digest", "sha1digest", "sha256digest", "sha512digest"}
+
+// mtreeEntry is one file of a spec, or of the tree being described.
+type mtreeEntry struct {
+	path string            // "." or "./dir/name"
+	file string            // path on disk, for the tree
+	kw   map[string]string // keyword values, decoded
+}
+
+// runMtree implements the mtree subcommand. Without -check it prints a BSD
+// mtree spec of DIR; with -check it compares DIR with a spec the way
+// mtree -f does, reporting content and metadata changes separately. The
+// exit status is 0 on success or a match, 1 for differences and 2 on
+// error.
+func runMtree(args []string) int {
+	fs := flag.NewFlagSet("mtree", flag.ExitOnError)
+	algos := fs.String("hash", "sha256", "comma-separated digests to record: md5, sha1, sha256, sha512")
+	check := fs.String("check", "", "compare DIR with this spec instead of writing one")
+	output := fs.String("o", "", "write the spec here instead of to stdout")
+	progress := fs.Bool("progress", false, "show progress updates")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s mtree [-hash sha256] [-o FILE] DIR\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "       %s mtree -check SPEC DIR\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	dir := fs.Arg(0)
+	ctx := signalContext()
+
+	if *check != "" {
+		clean, err := checkMtree(ctx, dir, *check, *progress, os.Stdout)
+		switch {
+		case err == errInterrupted:
+			return 130
+		case err != nil:
+			log.Print(err)
+			return 2
+		case !clean:
+			return 1
+		}
+		return 0
+	}
+
+	var digests []string
+	for _, a := range strings.Split(*algos, ",") {
+		a = strings.ToLower(strings.TrimSpace(a))
+		if !slices.Contains(mtreeAlgorithms, a) {
+			log.Printf("-hash: mtree has no %q digest", a)
+			return 2
+		}
+		digests = append(digests, a)
+	}
+	// Creating the spec changes the mtime of its directory, which may be
+	// in the tree, so it is created before the walk records that mtime.
+	// Writing to it later does not change the directory again.
+	created := false
+	if *output != "" {
+		if _, err := os.Lstat(*output); errors.Is(err, os.ErrNotExist) {
+			f, err := os.Create(*output)
+			if err != nil {
+				log.Print(err)
+				return 2
+			}
+			f.Close()
+			created = true
+		}
+	}
+	entries, err := mtreeWalk(ctx, dir, *output)
+	var failures map[string]error
+	if err == nil {
+		var files []*mtreeEntry
+		for _, e := range entries {
+			if e.kw["type"] == "file" {
+				files = append(files, e)
+			}
+		}
+		failures, err = mtreeDigests(ctx, files, digests, *progress)
+	}
+	if err != nil && created {
+		os.Remove(*output)
+	}
+	if err == errInterrupted {
+		return 130
+	}
+	if err != nil {
+		log.Print(err)
+		return 2
+	}
+
+	w := io.Writer(os.Stdout)
+	var f *os.File
+	if *output != "" {
+		if f, err = os.Create(*output); err != nil {
+			log.Print(err)
+			return 2
+		}
+		w = f
+	}
+	bw := bufio.NewWriter(w)
+	writeMtree(bw, dir, entries)
+	if f != nil {
+		err = finishFile(f, bw)
+	} else {
+		err = bw.Flush()
+	}
+	if err != nil {
+		log.Print(err)
+		return 2
+	}
+	if len(failures) > 0 {
+		log.Printf("%d files could not be hashed and have no digest", len(failures))
+		return 2
+	}
+	return 0
+}
+
+// mtreeWalk returns an entry with the metadata keywords of everything under
+// dir, dir itself included, in walk order. skip, if set, names a file to
+// leave out, such as the spec being written.
+func mtreeWalk(ctx context.Context, dir, skip string) ([]*mtreeEntry, error) {
+	if skip != "" {
+		skip, _ = filepath.Abs(skip)
+	}
+	var entries []*mtreeEntry
+	err := walkEntries(ctx, dir, func(p string, d os.DirEntry) error {
+		if abs, _ := filepath.Abs(p); abs == skip {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		e := &mtreeEntry{path: "./" + filepath.ToSlash(rel), file: p, kw: mtreeStat(fi)}
+		if rel == "." {
+			e.path = "."
+		}
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			if e.kw["link"], err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+		entries = append(entries, e)
+		return nil
+	})
+	return entries, err
+}
+
+// mtreeStat returns the keywords of the file fi describes that stat alone
+// provides.
+func mtreeStat(fi os.FileInfo) map[string]string {
+	kw := map[string]string{
+		"type": mtreeType(fi.Mode()),
+		"mode": fmt.Sprintf("%04o", unixMode(fi.Mode())),
+		"time": fmt.Sprintf("%d.%09d", fi.ModTime().Unix(), fi.ModTime().Nanosecond()),
+	}
+	if uid, gid, ok := fileOwner(fi); ok {
+		kw["uid"], kw["gid"] = strconv.Itoa(uid), strconv.Itoa(gid)
+	}
+	if n, ok := fileLinks(fi); ok {
+		kw["nlink"] = strconv.FormatUint(n, 10)
+	}
+	if fi.Mode().IsRegular() {
+		kw["size"] = strconv.FormatInt(fi.Size(), 10)
+	}
+	return kw
+}
+
+// mtreeType returns the mtree type of a file mode.
+func mtreeType(m fs.FileMode) string {
+	switch {
+	case m.IsDir():
+		return "dir"
+	case m&fs.ModeSymlink != 0:
+		return "link"
+	case m&fs.ModeNamedPipe != 0:
+		return "fifo"
+	case m&fs.ModeSocket != 0:
+		return "socket"
+	case m&fs.ModeCharDevice != 0:
+		return "char"
+	case m&fs.ModeDevice != 0:
+		return "block"
+	}
+	return "file"
+}
+
+// unixMode returns the permission bits of m as stat reports them.
+func unixMode(m fs.FileMode) uint32 {
+	bits := uint32(m.Perm())
+	if m&fs.ModeSetuid != 0 {
+		bits |= 0o4000
+	}
+	if m&fs.ModeSetgid != 0 {
+		bits |= 0o2000
+	}
+	if m&fs.ModeSticky != 0 {
+		bits |= 0o1000
+	}
+	return bits
+}
+
+// mtreeDigests hashes the files of entries with every algorithm in algos,
+// reading each file once, and stores the results as digest keywords. Files that fail get no digest and
+// are returned with their error.
+func mtreeDigests(ctx context.Context, entries []*mtreeEntry, algos []string, progress bool) (map[string]error, error) {
+	byFile := map[string]*mtreeEntry{}
+	var paths []string
+	for _, e := range entries {
+		byFile[e.file] = e
+		paths = append(paths, e.file)
+	}
+	var mu sync.Mutex
+	failures := map[string]error{}
+	sums, err := hashAll(ctx, paths, func(p string, read *atomic.Int64) (map[string]string, error) {
+		sums, err := hashMultiWithRetry(ctx, p, algos, read)
+		if err != nil {
+			mu.Lock()
+			failures[p] = err
+			mu.Unlock()
+		}
+		return sums, err
+	}, progress)
+	if err != nil {
+		return nil, err
+	}
+	for p, s := range sums {
+		for a, sum := range s {
+			byFile[p].kw[a+"digest"] = sum
+		}
+	}
+	return failures, nil
+}
+
+// writeMtree writes entries as a spec with full paths, the form mtree -C
+// and bsdtar produce, after a header like the one mtree writes.
+func writeMtree(w io.Writer, dir string, entries []*mtreeEntry) {
+	fmt.Fprintln(w, "#mtree")
+	if u, err := user.Current(); err == nil {
+		fmt.Fprintf(w, "#\t   user: %s\n", u.Username)
+	}
+	if host, err := os.Hostname(); err == nil {
+		fmt.Fprintf(w, "#\tmachine: %s\n", host)
+	}
+	if abs, err := filepath.Abs(dir); err == nil {
+		fmt.Fprintf(w, "#\t   tree: %s\n", abs)
+	}
+	fmt.Fprintf(w, "#\t   date: %s\n\n", time.Now().Format(time.ANSIC))
+	for _, e := range entries {
+		fmt.Fprint(w, mtreeEncode(e.path))
+		for _, k := range mtreeOrder {
+			if v, ok := e.kw[k]; ok && v != "" {
+				if k == "link" {
+					v = mtreeEncode(v)
+				}
+				fmt.Fprintf(w, " %s=%s", k, v)
+			}
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// mtreeEncode escapes a name the way mtree's strsvis does: white space,
+// glob characters, backslashes and anything not printable ASCII become
+// three-digit octal escapes.
+func mtreeEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c <= ' ' || c >= 0x7f || strings.IndexByte("\\#*?[", c) >= 0 {
+			fmt.Fprintf(&b, "\\%03o", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// mtreeDecode undoes mtreeEncode. It also accepts the C-style escapes
+// other mtree writers use.
+func mtreeDecode(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+3 < len(s) && isOctal(s[i+1]) && isOctal(s[i+2]) && isOctal(s[i+3]) {
+			b.WriteByte((s[i+1]-'0')<<6 | (s[i+2]-'0')<<3 | (s[i+3] - '0'))
+			i += 3
+			continue
+		}
+		i++
+		switch s[i] {
+		case 's':
+			b.WriteByte(' ')
+		case 't':
+			b.WriteByte('\t')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+func isOctal(c byte) bool { return c >= '0' && c <= '7' }
+
+// readMtree parses a spec in either the full-path or the hierarchical form
+// of mtree -c, honouring /set and /unset, and returns its entries in file
+// order with paths in the "./dir/name" form.
+func readMtree(specfile string) ([]*mtreeEntry, error) {
+	f, err := os.Open(specfile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	defaults := map[string]string{}
+	var entries []*mtreeEntry
+	cwd := "" // directory of relative names in the hierarchical form
+	var pending string
+	for n := 1; scanner.Scan(); n++ {
+		line := pending + scanner.Text()
+		if strings.HasSuffix(line, "\\") && !strings.HasSuffix(line, "\\\\") {
+			pending = strings.TrimSuffix(line, "\\") + " "
+			continue
+		}
+		pending = ""
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		kw := map[string]string{}
+		for _, f := range fields[1:] {
+			k, v, _ := strings.Cut(f, "=")
+			if slices.Contains(mtreeAlgorithms, k) {
+				k += "digest"
+			}
+			kw[k] = mtreeDecode(v)
+		}
+		switch fields[0] {
+		case "/set":
+			for k, v := range kw {
+				defaults[k] = v
+			}
+			continue
+		case "/unset":
+			for k := range kw {
+				if k == "all" {
+					clear(defaults)
+				}
+				delete(defaults, k)
+			}
+			continue
+		case "..":
+			if i := strings.LastIndex(cwd, "/"); i >= 0 {
+				cwd = cwd[:i]
+			} else {
+				cwd = ""
+			}
+			continue
+		}
+		if strings.HasPrefix(fields[0], "/") {
+			return nil, fmt.Errorf("%s:%d: unknown command %s", specfile, n, fields[0])
+		}
+
+		e := &mtreeEntry{kw: map[string]string{}}
+		for k, v := range defaults {
+			e.kw[k] = v
+		}
+		for k, v := range kw {
+			e.kw[k] = v
+		}
+		name := mtreeDecode(fields[0])
+		if strings.Contains(name, "/") {
+			e.path = path.Clean(name)
+			if e.path != "." {
+				e.path = "./" + strings.TrimPrefix(e.path, "./")
+			}
+		} else {
+			e.path = name
+			if cwd != "" {
+				e.path = cwd + "/" + name
+			}
+			if e.kw["type"] == "dir" {
+				cwd = e.path
+			}
+		}
+		entries = append(entries, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// checkMtree compares the tree under dir with a spec and prints every
+// difference. A file whose type, size, link target or digest changed is
+// reported as CONTENT; one where only its mode, owner, link count or mtime
+// did is reported as METADATA, with the keywords that differ. Files the
+// spec names that are gone are MISSING and files it does not name are
+// EXTRA; the optional and ignore keywords work as in mtree. Only the
+// keywords the spec has are checked. It returns whether dir matched.
+func checkMtree(ctx context.Context, dir, specfile string, progress bool, w io.Writer) (bool, error) {
+	spec, err := readMtree(specfile)
+	if err != nil {
+		return false, err
+	}
+	found, err := mtreeWalk(ctx, dir, specfile)
+	if err != nil {
+		return false, err
+	}
+	actual := map[string]*mtreeEntry{}
+	for _, e := range found {
+		actual[e.path] = e
+	}
+	var ignored []string
+	listed := map[string]bool{}
+	under := func(p string) bool {
+		return slices.ContainsFunc(ignored, func(d string) bool { return strings.HasPrefix(p, d+"/") })
+	}
+
+	// Hash only files that are still regular files of the recorded size;
+	// the others have already changed.
+	toHash := map[string][]*mtreeEntry{}
+	for _, e := range spec {
+		a := actual[e.path]
+		if a == nil || a.kw["type"] != "file" || e.kw["type"] != "" && e.kw["type"] != "file" ||
+			e.kw["size"] != "" && e.kw["size"] != a.kw["size"] {
+			continue
+		}
+		for _, alg := range mtreeAlgorithms {
+			if e.kw[alg+"digest"] != "" {
+				toHash[alg] = append(toHash[alg], a)
+			}
+		}
+	}
+	failures := map[string]error{}
+	for _, alg := range mtreeAlgorithms {
+		if len(toHash[alg]) == 0 {
+			continue
+		}
+		failed, err := mtreeDigests(ctx, toHash[alg], []string{alg}, progress)
+		if err != nil {
+			return false, err
+		}
+		for p, err := range failed {
+			failures[p] = err
+		}
+	}
+
+	var total, ok, content, metadata, missing, extra, unreadable int
+	for _, e := range spec {
+		if under(e.path) || listed[e.path] {
+			continue
+		}
+		listed[e.path] = true
+		if _, ok := e.kw["ignore"]; ok {
+			ignored = append(ignored, e.path)
+		}
+		a := actual[e.path]
+		if a == nil {
+			if _, ok := e.kw["optional"]; !ok {
+				total++
+				missing++
+				fmt.Fprintf(w, "%s MISSING\n", e.path)
+			}
+			continue
+		}
+		total++
+		if err := failures[a.file]; err != nil {
+			unreadable++
+			fmt.Fprintf(w, "%s UNREADABLE (%s)\n", e.path, errorMessage(err))
+			continue
+		}
+		changed, meta := mtreeCompare(e.kw, a.kw)
+		if len(changed) > 0 {
+			content++
+			fmt.Fprintf(w, "%s CONTENT (%s)\n", e.path, strings.Join(changed, "; "))
+		}
+		if len(meta) > 0 {
+			metadata++
+			fmt.Fprintf(w, "%s METADATA (%s)\n", e.path, strings.Join(meta, "; "))
+		}
+		if len(changed) == 0 && len(meta) == 0 {
+			ok++
+		}
+	}
+	for _, a := range found {
+		if !listed[a.path] && !under(a.path) {
+			extra++
+			fmt.Fprintf(w, "%s EXTRA\n", a.path)
+		}
+	}
+
+	if ok == total && extra == 0 {
+		fmt.Fprintln(w, "All files match the spec")
+	}
+	fmt.Fprintf(w, "Total:%d OK:%d CONTENT:%d METADATA:%d MISSING:%d EXTRA:%d UNREADABLE:%d\n",
+		total, ok, content, metadata, missing, extra, unreadable)
+	return ok == total && extra == 0, nil
+}
+
+// mtreeCompare returns the content and the metadata keywords of want that
+// got does not match, each as "keyword expected X, found Y". A changed type
+// makes the other keywords meaningless, so it is reported alone.
+func mtreeCompare(want, got map[string]string) (content, metadata []string) {
+	diff := func(k string) string {
+		return fmt.Sprintf("%s expected %s, found %s", k, want[k], got[k])
+	}
+	if want["type"] != "" && want["type"] != got["type"] {
+		return []string{diff("type")}, nil
+	}
+	_, nochange := want["nochange"]
+	for _, k := range mtreeOrder {
+		v, ok := want[k]
+		if !ok || k == "type" || nochange && !slices.Contains(mtreeContent, k) {
+			continue
+		}
+		// Keywords the file has no value for, such as the size of a
+		// directory, owners where stat has none, or digests of files not
+		// read because their size already differs, are not compared.
+		if _, known := got[k]; !known {
+			continue
+		}
+		var same bool
+		switch k {
+		case "mode":
+			m, err := strconv.ParseUint(v, 8, 32)
+			same = err == nil && fmt.Sprintf("%04o", m) == got[k]
+		case "time":
+			same = mtreeTimeMatches(v, got[k])
+		default:
+			same = strings.EqualFold(v, got[k])
+		}
+		if same {
+			continue
+		}
+		if slices.Contains(mtreeContent, k) {
+			content = append(content, diff(k))
+		} else {
+			metadata = append(metadata, diff(k))
+		}
+	}
+	return content, metadata
+}
+
+// mtreeTimeMatches reports whether the spec time want, "seconds.fraction",
+// matches got. A spec without a fraction, as written from sources that
+// only keep whole seconds, is compared to the second.
+func mtreeTimeMatches(want, got string) bool {
+	ws, wf, _ := strings.Cut(want, ".")
+	gs, gf, _ := strings.Cut(got, ".")
+	if ws != gs {
+		return false
+	}
+	if strings.Trim(wf, "0") == "" {
+		return true
+	}
+	// The fraction is in nanoseconds, padded or cut to nine digits.
+	wf = (wf + "000000000")[:9]
+	return wf == gf
+}
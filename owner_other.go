@@ -0,0 +1,13 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+func fileOwner(fi os.FileInfo) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
+
+func fileLinks(fi os.FileInfo) (uint64, bool) {
+	return 0, false
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// perDirMode writes and checks one manifest per directory instead of a
+// single list.
+var perDirMode bool
+
+// manifestPrefix starts the name of a per-directory manifest; the rest is
+// the algorithm, e.g. ".checksums.sha256".
+const manifestPrefix = ".checksums."
+
+// manifestAlgo returns the algorithm of a manifest file name, or false if
+// name is not a manifest.
+func manifestAlgo(name string) (string, bool) {
+	algo, ok := strings.CutPrefix(name, manifestPrefix)
+	if !ok || algo == "" || strings.HasSuffix(algo, ".tmp") {
+		return "", false
+	}
+	return algo, true
+}
+
+// formatManifestLine renders an entry the way sha256sum and friends do, so
+// a manifest can also be checked with them: "hash  name", with a leading
+// backslash and escapes if the name holds a backslash or newline.
+func formatManifestLine(hash, name string) string {
+	if strings.ContainsAny(name, "\\\n") {
+		name = strings.NewReplacer("\\", "\\\\", "\n", "\\n").Replace(name)
+		return "\\" + hash + "  " + name + "\n"
+	}
+	return hash + "  " + name + "\n"
+}
+
+// parseManifestLine is the inverse of formatManifestLine. It also accepts
+// the "hash *name" form of binary mode.
+func parseManifestLine(line string) (hash, name string, ok bool) {
+	escaped := strings.HasPrefix(line, "\\")
+	if escaped {
+		line = line[1:]
+	}
+	hash, name, ok = strings.Cut(line, " ")
+	if !ok || len(name) < 2 || (name[0] != ' ' && name[0] != '*') {
+		return "", "", false
+	}
+	name = name[1:]
+	if escaped {
+		name = strings.NewReplacer("\\\\", "\\", "\\n", "\n").Replace(name)
+	}
+	return hash, name, true
+}
+
+// generatePerDir hashes the regular files under dir and writes a manifest
+// named .checksums.<algo> into every directory that holds any, listing
+// its files by name. Manifests are replaced only once all files have been
+// hashed; those of algo in directories that no longer hold any files are
+// removed.
+func generatePerDir(ctx context.Context, dir string, progress bool, algo string, rep reporter) error {
+	all, _, err := walkRegular(ctx, dir)
+	if err != nil {
+		return err
+	}
+	name := manifestPrefix + algo
+	var paths, manifests []string
+	held := map[string]bool{} // directories with files to list
+	for _, p := range all {
+		if _, ok := manifestAlgo(filepath.Base(p)); !ok {
+			paths = append(paths, p)
+			held[filepath.Dir(p)] = true
+		} else if filepath.Base(p) == name {
+			manifests = append(manifests, p)
+		}
+	}
+	report := newGenerateReport(rep)
+	sums, err := hashAll(ctx, paths, report.wrap(func(p string, read *atomic.Int64) (string, error) {
+		return hashWithRetry(ctx, p, algo, read)
+	}), progress)
+	if err != nil {
+		return err
+	}
+	if err := report.close(len(paths)); err != nil {
+		return err
+	}
+
+	byDir := map[string][]string{}
+	for _, p := range paths {
+		if _, ok := sums[p]; ok {
+			d := filepath.Dir(p)
+			byDir[d] = append(byDir[d], p)
+		}
+	}
+	for _, d := range sortedKeys(byDir) {
+		var b strings.Builder
+		for _, p := range byDir[d] {
+			b.WriteString(formatManifestLine(sums[p], filepath.Base(p)))
+		}
+		if err := writeFileAtomic(filepath.Join(d, name), []byte(b.String())); err != nil {
+			return err
+		}
+	}
+	// Left in place, the manifest of a directory emptied since the last
+	// run would report its files MISSING.
+	removed := 0
+	for _, m := range manifests {
+		if !held[filepath.Dir(m)] {
+			if err := os.Remove(m); err != nil {
+				return err
+			}
+			removed++
+		}
+	}
+	fmt.Printf("Wrote %d manifests for %d files\n", len(byDir), len(sums))
+	if removed > 0 {
+		fmt.Printf("Removed %d manifests of directories without files\n", removed)
+	}
+	if len(sums) < len(paths) {
+		return fmt.Errorf("%d files could not be hashed and are not in any manifest", len(paths)-len(sums))
+	}
+	return nil
+}
+
+// writeFileAtomic replaces path with data through a temporary file in the
+// same directory.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	w.Write(data)
+	if err := finishFile(f, w); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// manifestEntry is a file named by a per-directory manifest.
+type manifestEntry struct {
+	hash, algo, manifest string
+}
+
+// verifyPerDir finds every .checksums.* manifest under dir and checks the
+// files they name, all manifests sharing one worker pool. Files next to a
+// manifest that it does not name are NOT_IN_LIST.
+func verifyPerDir(ctx context.Context, dir string, show statusSet, progress bool, rep reporter) error {
+	col := newVerifyCollector(show, rep)
+	all, _, err := walkRegular(ctx, dir)
+	if err != nil {
+		return err
+	}
+	expected := map[string]manifestEntry{}
+	covered := map[string]bool{} // directories with a manifest
+	var manifests int
+	for _, m := range all {
+		algo, ok := manifestAlgo(filepath.Base(m))
+		if !ok {
+			continue
+		}
+		if digestsDiffer[algo] {
+			return fmt.Errorf("%s: %s digests depend on the implementation in the build and cannot be verified from a manifest", m, algo)
+		}
+		manifests++
+		d := filepath.Dir(m)
+		covered[d] = true
+		if err := readManifest(m, func(hash, name string) {
+			expected[filepath.Join(d, name)] = manifestEntry{hash, algo, m}
+		}); err != nil {
+			return err
+		}
+	}
+	if manifests == 0 {
+		return fmt.Errorf("no %s* manifests found under %s", manifestPrefix, dir)
+	}
+
+	paths := sortedKeys(expected)
+	var mu sync.Mutex
+	failures := map[string]error{}
+	sums, err := hashAll(ctx, paths, func(p string, read *atomic.Int64) (string, error) {
+		sum, err := hashWithRetry(ctx, p, expected[p].algo, read)
+		if err != nil {
+			mu.Lock()
+			failures[p] = err
+			mu.Unlock()
+		}
+		return sum, err
+	}, progress)
+	if err != nil {
+		return err
+	}
+
+	report := func(r fileResult) {
+		if fi, err := os.Stat(r.path); err == nil {
+			r.size = fi.Size()
+		}
+		col.add(r)
+	}
+	for _, p := range paths {
+		r := fileResult{path: p, expected: expected[p].hash, actual: sums[p], err: failures[p]}
+		r.status = statusOf(r.err, r.expected, r.actual)
+		report(r)
+	}
+	if show[statusNotInList] {
+		for _, p := range all {
+			_, isManifest := manifestAlgo(filepath.Base(p))
+			if _, ok := expected[p]; !ok && !isManifest && covered[filepath.Dir(p)] {
+				report(fileResult{path: p, status: statusNotInList})
+			}
+		}
+	}
+
+	col.summarize(len(paths), fmt.Sprintf("All files in %d manifests match", manifests))
+	return col.close(len(paths))
+}
+
+// readManifest calls fn for every entry of a per-directory manifest.
+func readManifest(path string, fn func(hash, name string)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if line == "" || isHeaderLine(line) {
+			continue
+		}
+		hash, name, ok := parseManifestLine(line)
+		if !ok || strings.Contains(name, "/") || slices.Contains([]string{".", ".."}, name) {
+			return fmt.Errorf("%s:%d: malformed manifest line", path, n)
+		}
+		fn(hash, name)
+	}
+	return scanner.Err()
+}
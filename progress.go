@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// progressMeter tracks files and bytes hashed by a worker pool and renders
+// them to stderr. A nil meter is valid and does nothing, so workers can
+// report unconditionally.
+type progressMeter struct {
+	out        io.Writer
+	tty        bool
+	start      time.Time
+	files      int64
+	bytes      int64
+	sizes      map[string]int64
+	doneFiles  atomic.Int64
+	doneBytes  atomic.Int64
+	workers    []workerSlot
+	stop, done chan struct{}
+}
+
+// workerSlot is the file a worker is currently hashing.
+type workerSlot struct {
+	cur  atomic.Pointer[inFlight]
+	read atomic.Int64
+}
+
+type inFlight struct {
+	path  string
+	size  int64
+	start time.Time
+}
+
+// stuckAfter is how long a worker must spend on one file before the line
+// renderer lists it separately.
+const stuckAfter = 10 * time.Second
+
+// newProgressMeter returns a meter for files jobs, or nil when progress
+// reporting is off. sizes maps paths to their expected size and is used for
+// the byte totals and the ETA.
+func newProgressMeter(enabled bool, files int, sizes map[string]int64, workers int) *progressMeter {
+	if !enabled {
+		return nil
+	}
+	m := &progressMeter{
+		out:     os.Stderr,
+		tty:     isTerminal(os.Stderr),
+		start:   time.Now(),
+		files:   int64(files),
+		sizes:   sizes,
+		workers: make([]workerSlot, workers),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	for _, s := range sizes {
+		m.bytes += s
+	}
+	return m
+}
+
+// expectBytes sets the bytes to hash when the sizes of the files are not
+// known up front.
+func (m *progressMeter) expectBytes(n int64) {
+	if m != nil {
+		m.bytes = n
+	}
+}
+
+// isTerminal reports whether f is a character device such as a terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// begin marks path as being hashed by worker w and returns the counter the
+// hash function should add read bytes to.
+func (m *progressMeter) begin(w int, path string) *atomic.Int64 {
+	if m == nil {
+		return nil
+	}
+	s := &m.workers[w]
+	s.read.Store(0)
+	s.cur.Store(&inFlight{path: path, size: m.sizes[path], start: time.Now()})
+	return &s.read
+}
+
+// end marks the current file of worker w as finished.
+func (m *progressMeter) end(w int) {
+	if m == nil {
+		return
+	}
+	s := &m.workers[w]
+	s.cur.Store(nil)
+	m.doneBytes.Add(s.read.Swap(0))
+	m.doneFiles.Add(1)
+}
+
+// run renders progress until finish is called.
+func (m *progressMeter) run() {
+	if m == nil {
+		return
+	}
+	interval := time.Second
+	if m.tty {
+		interval = 250 * time.Millisecond
+	}
+	go func() {
+		defer close(m.done)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				m.render(false)
+			case <-m.stop:
+				m.render(true)
+				return
+			}
+		}
+	}()
+}
+
+// finish stops the renderer after drawing the final state and prints the
+// elapsed time.
+func (m *progressMeter) finish() {
+	if m == nil {
+		return
+	}
+	close(m.stop)
+	<-m.done
+	fmt.Fprintf(m.out, "Time elapsed: %s\n", time.Since(m.start).Round(time.Second))
+}
+
+func (m *progressMeter) render(final bool) {
+	files := m.doneFiles.Load()
+	done := m.doneBytes.Load()
+	var busy []*inFlight
+	var busyRead []int64
+	for i := range m.workers {
+		s := &m.workers[i]
+		if f := s.cur.Load(); f != nil {
+			busy = append(busy, f)
+			r := s.read.Load()
+			busyRead = append(busyRead, r)
+			done += r
+		}
+	}
+
+	elapsed := time.Since(m.start)
+	rate := float64(done) / elapsed.Seconds()
+	line := fmt.Sprintf("%d/%d files  %s/%s", files, m.files, formatBytes(done), formatBytes(m.bytes))
+	if m.bytes > 0 {
+		line += fmt.Sprintf(" (%.0f%%)", 100*float64(done)/float64(m.bytes))
+	}
+	line += fmt.Sprintf("  %s/s", formatBytes(int64(rate)))
+	if !final && rate > 0 && m.bytes > done {
+		eta := time.Duration(float64(m.bytes-done) / rate * float64(time.Second))
+		line += "  ETA " + eta.Round(time.Second).String()
+	}
+
+	if m.tty {
+		// Single line: overall state plus the file that has been in flight
+		// the longest, which is what a seemingly frozen run is stuck on.
+		if !final && len(busy) > 0 {
+			oldest := 0
+			for i := range busy {
+				if busy[i].start.Before(busy[oldest].start) {
+					oldest = i
+				}
+			}
+			line += fmt.Sprintf("  [%d busy] %s", len(busy), describeInFlight(busy[oldest], busyRead[oldest]))
+		}
+		end := "\x1b[K"
+		if final {
+			end += "\n"
+		}
+		fmt.Fprintf(m.out, "\r%s%s", line, end)
+		return
+	}
+
+	fmt.Fprintln(m.out, line)
+	if final {
+		return
+	}
+	for i, f := range busy {
+		if time.Since(f.start) >= stuckAfter {
+			fmt.Fprintf(m.out, "  %s\n", describeInFlight(f, busyRead[i]))
+		}
+	}
+}
+
+func describeInFlight(f *inFlight, read int64) string {
+	s := filepath.Base(f.path)
+	if f.size > 0 {
+		s += fmt.Sprintf(" %s/%s", formatBytes(read), formatBytes(f.size))
+	}
+	return s + " " + time.Since(f.start).Round(time.Second).String()
+}
+
+// formatBytes renders n with a binary unit, e.g. "1.5 GiB".
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// countingReader adds the bytes read through it to n.
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	k, err := c.r.Read(p)
+	c.n.Add(int64(k))
+	return k, err
+}
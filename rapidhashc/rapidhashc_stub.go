@@ -4,6 +4,14 @@ package rapidhashc
 
 import "CheckSumFolder/rapidhash"
 
+// Backend names the implementation compiled into this build.
+const Backend = "go"
+
 func Sum64(b []byte) uint64 {
 	return rapidhash.Hash(b)
 }
+
+// Sum64Seed hashes b with the given seed instead of the default one.
+func Sum64Seed(b []byte, seed uint64) uint64 {
+	return rapidhash.HashWithSeed(b, seed)
+}
@@ -0,0 +1,39 @@
+//go:build cgo && (amd64 || arm64)
+
+package rapidhashc
+
+import "testing"
+
+// knownAnswers are the bundled C rapidhash digests without a seed and with seed
+// 42. The pure Go fallback used in builds without cgo implements a
+// different revision and is not expected to match.
+var knownAnswers = []struct {
+	in   string
+	want [2]uint64
+}{
+	{"", [2]uint64{0x0000000000000000, 0x9293ba21a570895d}},
+	{"a", [2]uint64{0x599f47df33a2e1eb, 0x0c4b4535681ad65d}},
+	{"abc", [2]uint64{0xcb475beafa9c0da2, 0xc9ec8265a55d0854}},
+	{"message digest", [2]uint64{0x489e17c8eba5e6e7, 0x18cb167fa30dd764}},
+	{"The quick brown fox jumps over the lazy dog", [2]uint64{0x91722dc8d52a3f7b, 0x49883dccb32018fa}},
+	{counting(1000), [2]uint64{0x2a6be558a956faf3, 0x937f8e9754810e44}},
+}
+
+func counting(n int) string {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i)
+	}
+	return string(b)
+}
+
+func TestKnownAnswers(t *testing.T) {
+	for _, tc := range knownAnswers {
+		if got := Sum64([]byte(tc.in)); got != tc.want[0] {
+			t.Errorf("%d bytes: got %#016x, want %#016x", len(tc.in), got, tc.want[0])
+		}
+		if got := Sum64Seed([]byte(tc.in), 42); got != tc.want[1] {
+			t.Errorf("%d bytes, seed 42: got %#016x, want %#016x", len(tc.in), got, tc.want[1])
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// fileResult is the outcome of verifying one file.
+type fileResult struct {
+	path     string
+	expected string
+	actual   string
+	status   verifyStatus
+	size     int64
+	duration time.Duration
+	err      error
+}
+
+func (r fileResult) errorText() string {
+	if r.err == nil {
+		return ""
+	}
+	return errorMessage(r.err)
+}
+
+// reporter writes verify results to a -report file.
+type reporter interface {
+	add(r fileResult) error
+	// close writes the summary, if the format has one, and closes the file.
+	close(total int, counts [numStatuses]int, elapsed time.Duration) error
+}
+
+// multiReporter sends results to several reporters.
+type multiReporter []reporter
+
+func (m multiReporter) add(r fileResult) error {
+	var first error
+	for _, rep := range m {
+		if err := rep.add(r); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (m multiReporter) close(total int, counts [numStatuses]int, elapsed time.Duration) error {
+	var first error
+	for _, rep := range m {
+		if err := rep.close(total, counts, elapsed); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// generateReport sends the files a generate run hashes to a reporter, from
+// any number of workers. Its methods do nothing without a reporter.
+type generateReport struct {
+	rep   reporter
+	start time.Time
+	mu    sync.Mutex
+	err   error
+}
+
+func newGenerateReport(rep reporter) *generateReport {
+	return &generateReport{rep: rep, start: time.Now()}
+}
+
+// add reports the result of hashing path, which took since start.
+func (g *generateReport) add(path, hash string, err error, start time.Time) {
+	if g.rep == nil {
+		return
+	}
+	r := fileResult{path: path, actual: hash, status: statusOf(err, hash, hash), duration: time.Since(start), err: err}
+	if fi, err := os.Stat(path); err == nil {
+		r.size = fi.Size()
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err := g.rep.add(r); err != nil && g.err == nil {
+		g.err = err
+	}
+}
+
+// wrap returns fn, a hash function for hashAll, reporting every file.
+func (g *generateReport) wrap(fn func(string, *atomic.Int64) (string, error)) func(string, *atomic.Int64) (string, error) {
+	if g.rep == nil {
+		return fn
+	}
+	return func(p string, read *atomic.Int64) (string, error) {
+		start := time.Now()
+		sum, err := fn(p, read)
+		g.add(p, sum, err, start)
+		return sum, err
+	}
+}
+
+// close writes the report once total files were hashed.
+func (g *generateReport) close(total int) error {
+	if g.rep == nil {
+		return nil
+	}
+	if err := g.rep.close(total, [numStatuses]int{}, time.Since(g.start)); err != nil && g.err == nil {
+		g.err = err
+	}
+	if g.err != nil {
+		return fmt.Errorf("writing report: %w", g.err)
+	}
+	return nil
+}
+
+// newReporter creates path and returns a reporter writing format to it.
+func newReporter(path, format string) (reporter, error) {
+	switch format {
+	case "json", "csv", "junit":
+	default:
+		return nil, fmt.Errorf("unknown report format %q (want json, csv or junit)", format)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(f)
+	switch format {
+	case "csv":
+		c := csv.NewWriter(w)
+		c.Write([]string{"path", "expected", "actual", "status", "size", "duration", "error"})
+		return &csvReporter{f: f, w: w, c: c}, nil
+	case "junit":
+		return &junitReporter{f: f, w: w}, nil
+	}
+	if _, err := w.WriteString("{\"results\":[\n"); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &jsonReporter{f: f, w: w}, nil
+}
+
+func seconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 6, 64)
+}
+
+// finishFile flushes w and syncs and closes f.
+func finishFile(f *os.File, w *bufio.Writer) error {
+	err := w.Flush()
+	if e := f.Sync(); err == nil {
+		err = e
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// jsonReporter streams the results as an array followed by a summary so
+// that large verifications need not be held in memory.
+type jsonReporter struct {
+	f *os.File
+	w *bufio.Writer
+	n int
+}
+
+type jsonResult struct {
+	Path     string  `json:"path"`
+	Expected string  `json:"expected,omitempty"`
+	Actual   string  `json:"actual,omitempty"`
+	Status   string  `json:"status"`
+	Size     int64   `json:"size"`
+	Duration float64 `json:"duration"`
+	Error    string  `json:"error,omitempty"`
+}
+
+func (j *jsonReporter) add(r fileResult) error {
+	b, err := json.Marshal(jsonResult{
+		Path:     r.path,
+		Expected: r.expected,
+		Actual:   r.actual,
+		Status:   r.status.String(),
+		Size:     r.size,
+		Duration: r.duration.Seconds(),
+		Error:    r.errorText(),
+	})
+	if err != nil {
+		return err
+	}
+	if j.n > 0 {
+		j.w.WriteString(",\n")
+	}
+	j.n++
+	_, err = j.w.Write(b)
+	return err
+}
+
+func (j *jsonReporter) close(total int, counts [numStatuses]int, elapsed time.Duration) error {
+	summary := struct {
+		Total    int            `json:"total"`
+		Counts   map[string]int `json:"counts"`
+		Duration float64        `json:"duration"`
+	}{total, map[string]int{}, elapsed.Seconds()}
+	for s, n := range counts {
+		summary.Counts[verifyStatus(s).String()] = n
+	}
+	b, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(j.w, "\n],\"summary\":%s}\n", b)
+	return finishFile(j.f, j.w)
+}
+
+type csvReporter struct {
+	f *os.File
+	w *bufio.Writer
+	c *csv.Writer
+}
+
+func (c *csvReporter) add(r fileResult) error {
+	return c.c.Write([]string{
+		r.path, r.expected, r.actual, r.status.String(),
+		strconv.FormatInt(r.size, 10), seconds(r.duration), r.errorText(),
+	})
+}
+
+func (c *csvReporter) close(int, [numStatuses]int, time.Duration) error {
+	c.c.Flush()
+	if err := c.c.Error(); err != nil {
+		c.f.Close()
+		return err
+	}
+	return finishFile(c.f, c.w)
+}
+
+// junitReporter renders every file as a test case. JUnit puts the totals
+// before the cases, so the results are kept until close.
+type junitReporter struct {
+	f     *os.File
+	w     *bufio.Writer
+	cases []junitCase
+}
+
+type junitSuite struct {
+	XMLName  xml.Name    `xml:"testsuite"`
+	Name     string      `xml:"name,attr"`
+	Tests    int         `xml:"tests,attr"`
+	Failures int         `xml:"failures,attr"`
+	Errors   int         `xml:"errors,attr"`
+	Time     string      `xml:"time,attr"`
+	Cases    []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitProblem `xml:"failure,omitempty"`
+	Error     *junitProblem `xml:"error,omitempty"`
+}
+
+type junitProblem struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+func (j *junitReporter) add(r fileResult) error {
+	c := junitCase{Name: filepath.Base(r.path), ClassName: filepath.Dir(r.path), Time: seconds(r.duration)}
+	p := &junitProblem{Message: r.status.String(), Type: r.status.String()}
+	switch r.status {
+	case statusOK:
+		p = nil
+	case statusMismatch, statusModified, statusCorrupted:
+		p.Text = fmt.Sprintf("expected %s, got %s", r.expected, r.actual)
+		c.Failure = p
+	case statusNotInList:
+		p.Text = "file is not in the checksum list"
+		c.Failure = p
+	case statusStale:
+		p.Text = "file changed since it was hashed and was not read"
+		c.Failure = p
+	default:
+		p.Text = r.errorText()
+		c.Error = p
+	}
+	j.cases = append(j.cases, c)
+	return nil
+}
+
+func (j *junitReporter) close(_ int, counts [numStatuses]int, elapsed time.Duration) error {
+	s := junitSuite{
+		Name:     "CheckSumFolder verify",
+		Tests:    len(j.cases),
+		Failures: counts[statusMismatch] + counts[statusModified] + counts[statusCorrupted] + counts[statusNotInList] + counts[statusStale],
+		Errors:   counts[statusMissing] + counts[statusUnreadable] + counts[statusUnstable],
+		Time:     seconds(elapsed),
+		Cases:    j.cases,
+	}
+	j.w.WriteString(xml.Header)
+	enc := xml.NewEncoder(j.w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(s); err != nil {
+		j.f.Close()
+		return err
+	}
+	j.w.WriteString("\n")
+	return finishFile(j.f, j.w)
+}
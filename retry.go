@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// readTimeout bounds how long a single read may stall; zero disables it.
+// retries and retryWait control how often, and after how long a first
+// pause, a file failing with a transient error is hashed again. The wait
+// doubles on every attempt. Set from -read-timeout, -retries and
+// -retry-wait.
+var (
+	readTimeout time.Duration
+	retries     int
+	retryWait   = time.Second
+)
+
+var (
+	errReadTimeout = errors.New("read timed out")
+	errUnstable    = errors.New("file changed while being hashed")
+)
+
+// timeoutBufSize is the read size used when -read-timeout is set, large
+// enough that the goroutine per read does not show.
+const timeoutBufSize = 1 << 20
+
+// transient reports whether err may go away when the file is read again.
+func transient(err error) bool {
+	return errors.Is(err, errReadTimeout) ||
+		errors.Is(err, syscall.EIO) ||
+		errors.Is(err, syscall.EAGAIN) ||
+		errors.Is(err, syscall.EINTR) ||
+		errors.Is(err, syscall.ETIMEDOUT) ||
+		errors.Is(err, syscall.ESTALE)
+}
+
+// hashWithRetry calls hashFile, retrying transient failures with
+// exponential backoff until retries is exhausted or ctx is cancelled.
+func hashWithRetry(ctx context.Context, path, algo string, read *atomic.Int64) (string, error) {
+	return withRetry(ctx, read, func() (string, error) {
+		return hashFile(path, algo, read)
+	})
+}
+
+// hashMultiWithRetry is hashWithRetry for hashFileMulti.
+func hashMultiWithRetry(ctx context.Context, path string, algos []string, read *atomic.Int64) (map[string]string, error) {
+	return withRetry(ctx, read, func() (map[string]string, error) {
+		return hashFileMulti(path, algos, read)
+	})
+}
+
+func withRetry[T any](ctx context.Context, read *atomic.Int64, fn func() (T, error)) (T, error) {
+	wait := retryWait
+	for attempt := 0; ; attempt++ {
+		sum, err := fn()
+		if err == nil || attempt >= retries || !transient(err) {
+			return sum, err
+		}
+		log.Printf("%v; retrying in %s (%d/%d)", err, wait, attempt+1, retries)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			var zero T
+			return zero, err
+		}
+		wait *= 2
+		if read != nil {
+			read.Store(0)
+		}
+	}
+}
+
+// unchanged reports whether a file kept its size and modification time.
+func unchanged(a, b os.FileInfo) bool {
+	return a.Size() == b.Size() && a.ModTime().Equal(b.ModTime())
+}
+
+// withTimeout runs fn and gives up after readTimeout. On timeout fn keeps
+// running in the background, so it must not touch memory the caller will
+// reuse.
+func withTimeout(fn func() (int, error)) (int, error) {
+	type result struct {
+		n   int
+		err error
+	}
+	c := make(chan result, 1)
+	go func() {
+		n, err := fn()
+		c <- result{n, err}
+	}()
+	t := time.NewTimer(readTimeout)
+	defer t.Stop()
+	select {
+	case r := <-c:
+		return r.n, r.err
+	case <-t.C:
+		return 0, errReadTimeout
+	}
+}
+
+// timeoutReader reads through a private buffer so that a read abandoned
+// after a timeout cannot write into the caller's memory later. Once a read
+// timed out every further read fails.
+type timeoutReader struct {
+	r    io.Reader
+	buf  []byte
+	dead bool
+}
+
+// newTimeoutReader wraps r when -read-timeout is set.
+func newTimeoutReader(r io.Reader) io.Reader {
+	if readTimeout <= 0 {
+		return r
+	}
+	return bufio.NewReaderSize(&timeoutReader{r: r, buf: make([]byte, timeoutBufSize)}, timeoutBufSize)
+}
+
+func (t *timeoutReader) Read(p []byte) (int, error) {
+	if t.dead {
+		return 0, errReadTimeout
+	}
+	buf := t.buf[:min(len(p), len(t.buf))]
+	n, err := withTimeout(func() (int, error) { return t.r.Read(buf) })
+	if err == errReadTimeout {
+		t.dead = true
+		t.buf = nil
+		return 0, err
+	}
+	copy(p, buf[:n])
+	return n, err
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// verifyStatus is the outcome of verifying one file.
+type verifyStatus int
+
+const (
+	statusOK         verifyStatus = iota
+	statusMismatch                // content hash differs from the list
+	statusModified                // hash differs and so do size or mtime
+	statusCorrupted               // hash differs but size and mtime do not
+	statusMissing                 // listed file does not exist
+	statusUnreadable              // listed file exists but could not be read
+	statusUnstable                // file changed while it was being hashed
+	statusNotInList               // file under -dir that the list does not name
+	statusStale                   // changed since -xattr hashed it, not read
+	numStatuses
+)
+
+var statusNames = [numStatuses]string{"OK", "MISMATCH", "MODIFIED", "CORRUPTED", "MISSING", "UNREADABLE", "UNSTABLE", "NOT_IN_LIST", "STALE"}
+
+func (s verifyStatus) String() string {
+	if s < 0 || s >= numStatuses {
+		return fmt.Sprintf("verifyStatus(%d)", int(s))
+	}
+	return statusNames[s]
+}
+
+// statusOf classifies the result of hashing a listed file.
+func statusOf(err error, expected, actual string) verifyStatus {
+	switch {
+	case errors.Is(err, errUnstable):
+		return statusUnstable
+	case errors.Is(err, fs.ErrNotExist):
+		return statusMissing
+	case err != nil:
+		return statusUnreadable
+	case expected != actual:
+		return statusMismatch
+	}
+	return statusOK
+}
+
+// classifyMismatch tells an edited file from a corrupted one by the size
+// and mtime recorded with its checksum. Editing a file through the
+// filesystem moves its mtime; contents that changed while neither size nor
+// mtime did point to bit rot or tampering.
+func classifyMismatch(size, mtime int64, fi os.FileInfo) verifyStatus {
+	if fi.Size() != size || fi.ModTime().UnixNano() != mtime {
+		return statusModified
+	}
+	return statusCorrupted
+}
+
+// errCorrupted is returned by a verification that found CORRUPTED files,
+// after reporting them; the process then exits with exitCorrupted.
+var errCorrupted = errors.New("corrupted files found")
+
+// exitCorrupted is the exit status of a verification that found
+// corruption, distinct from 1 for errors.
+const exitCorrupted = 3
+
+// printCorrupted prints the summary section naming every corrupted file.
+// It appears whatever -show selects, as these files need attention.
+func printCorrupted(paths []string) {
+	if len(paths) == 0 {
+		return
+	}
+	slices.Sort(paths)
+	fmt.Printf("\nCorrupted files, contents changed with unchanged size and mtime (%d):\n", len(paths))
+	for _, p := range paths {
+		fmt.Printf("  %s\n", p)
+	}
+}
+
+// verifyCollector tallies the results of a verification, passes them to
+// the reporter and prints those show selects. Every verify mode reports
+// through one, so that statuses are printed and summarised alike. It is
+// not safe for concurrent use.
+type verifyCollector struct {
+	show      statusSet
+	stale     bool // whether the mode reports STALE files
+	rep       reporter
+	start     time.Time
+	counts    [numStatuses]int
+	corrupted []string
+	repErr    error
+}
+
+func newVerifyCollector(show statusSet, rep reporter) *verifyCollector {
+	return &verifyCollector{show: show, rep: rep, start: time.Now()}
+}
+
+func (c *verifyCollector) add(r fileResult) {
+	c.counts[r.status]++
+	if r.status == statusCorrupted {
+		c.corrupted = append(c.corrupted, r.path)
+	}
+	if c.rep != nil && c.repErr == nil {
+		c.repErr = c.rep.add(r)
+	}
+	if !c.show[r.status] {
+		return
+	}
+	if r.err != nil && r.status != statusMissing {
+		fmt.Printf("%s %s (%s)\n", r.path, r.status, errorMessage(r.err))
+	} else {
+		fmt.Printf("%s %s\n", r.path, r.status)
+	}
+}
+
+// summarize prints match if all total checked files are OK and none is
+// NOT_IN_LIST, then the counts and the corrupted files. The NOT_IN_LIST and
+// STALE counts are only printed when those files were looked for.
+func (c *verifyCollector) summarize(total int, match string) {
+	if match != "" && c.counts[statusOK] == total && c.counts[statusNotInList] == 0 {
+		fmt.Println(match)
+	}
+	fmt.Printf("Total:%d", total)
+	for s, n := range c.counts {
+		switch verifyStatus(s) {
+		case statusNotInList:
+			if !c.show[statusNotInList] {
+				continue
+			}
+		case statusStale:
+			if !c.stale {
+				continue
+			}
+		}
+		fmt.Printf(" %s:%d", verifyStatus(s), n)
+	}
+	fmt.Println()
+	printCorrupted(c.corrupted)
+}
+
+// close closes the reporter. It returns errCorrupted if corrupted files were
+// found and the report was written.
+func (c *verifyCollector) close(total int) error {
+	if c.rep != nil {
+		if err := c.rep.close(total, c.counts, time.Since(c.start)); err != nil && c.repErr == nil {
+			c.repErr = err
+		}
+		if c.repErr != nil {
+			return fmt.Errorf("writing report: %w", c.repErr)
+		}
+	}
+	if len(c.corrupted) > 0 {
+		return errCorrupted
+	}
+	return nil
+}
+
+// statusSet selects statuses, e.g. those to print.
+type statusSet [numStatuses]bool
+
+// defaultShow returns the statuses printed without -show: every failure,
+// plus OK when verbose. NOT_IN_LIST needs a walk of -dir and is only
+// checked when asked for explicitly.
+func defaultShow(verbose bool) statusSet {
+	var s statusSet
+	for i := range s {
+		s[i] = verifyStatus(i) != statusNotInList
+	}
+	s[statusOK] = verbose
+	return s
+}
+
+// parseShow parses a -show list such as "mismatch,missing". "all" selects
+// every status including NOT_IN_LIST.
+func parseShow(spec string) (statusSet, error) {
+	var s statusSet
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.ToUpper(strings.TrimSpace(name))
+		if name == "ALL" {
+			for i := range s {
+				s[i] = true
+			}
+			continue
+		}
+		found := false
+		for i, n := range statusNames {
+			if name == n || name == strings.ReplaceAll(n, "_", "-") {
+				s[i] = true
+				found = true
+			}
+		}
+		if !found {
+			return s, fmt.Errorf("unknown status %q (want %s or all)", name, strings.ToLower(strings.Join(statusNames[:], ",")))
+		}
+	}
+	return s, nil
+}
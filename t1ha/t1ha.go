@@ -14,6 +14,9 @@ package t1ha
 import "C"
 import "unsafe"
 
+// Backend names the implementation compiled into this build.
+const Backend = "c"
+
 // Sum64 computes the t1ha1 hash of data with the given seed.
 func Sum64(data []byte, seed uint64) uint64 {
 	var ptr unsafe.Pointer
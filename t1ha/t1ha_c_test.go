@@ -0,0 +1,25 @@
+//go:build cgo && (amd64 || arm64)
+
+package t1ha
+
+import "testing"
+
+// t1ha2_atonce128 digests (high, low) with seed 0. The Go fallback does not
+// implement t1ha2, which is why -impl offers no go choice for it.
+var t1ha2Answers = [][2]uint64{
+	{0x87971bdcefd96b8d, 0x4ec7f6a48e33b00a},
+	{0xc4b9489afdfd5af3, 0xcf83b4c4e3d78393},
+	{0xfeb7d424570ae06a, 0xa62a8987d5be9540},
+	{0x728e7265136489e4, 0x33fb973eaa429286},
+	{0x5891d221cdf47975, 0x8dd36078748f9731},
+	{0xe64dc4b251546832, 0xacac530948df15c6},
+}
+
+func TestSum128KnownAnswers(t *testing.T) {
+	for i, in := range testInputs {
+		lo, hi := Sum128([]byte(in), 0)
+		if want := t1ha2Answers[i]; hi != want[0] || lo != want[1] {
+			t.Errorf("%d bytes: got %016x%016x, want %016x%016x", len(in), hi, lo, want[0], want[1])
+		}
+	}
+}
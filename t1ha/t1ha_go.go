@@ -0,0 +1,9 @@
+package t1ha
+
+import dgt1ha "github.com/dgryski/go-t1ha"
+
+// Sum64Go computes a 64-bit t1ha1 hash of data with the given seed using the
+// pure-Go implementation. It produces the same digests as the C t1ha1_le.
+func Sum64Go(data []byte, seed uint64) uint64 {
+	return dgt1ha.Sum64(data, seed)
+}
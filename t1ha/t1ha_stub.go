@@ -4,9 +4,12 @@ package t1ha
 
 import dgt1ha "github.com/dgryski/go-t1ha"
 
+// Backend names the implementation compiled into this build.
+const Backend = "go"
+
 // Sum64 computes a 64-bit t1ha1 hash of data with the given seed using the pure-Go implementation.
 func Sum64(data []byte, seed uint64) uint64 {
-	return dgt1ha.Sum64(data, seed)
+	return Sum64Go(data, seed)
 }
 
 // Sum64T1ha2 computes the 64-bit t1ha2 hash of data with the given seed using the pure-Go implementation.
@@ -0,0 +1,48 @@
+package t1ha
+
+import "testing"
+
+// testInputs are the messages the known answers below were computed for
+// with the reference C implementation.
+var testInputs = []string{
+	"",
+	"a",
+	"abc",
+	"message digest",
+	"The quick brown fox jumps over the lazy dog",
+	string(counting(1000)),
+}
+
+func counting(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i)
+	}
+	return b
+}
+
+// t1ha1 digests for seeds 0 and 42.
+var t1ha1Answers = [][2]uint64{
+	{0x0000000000000000, 0x77fcff2a2dd2ef93},
+	{0x10a90771c9c0828c, 0xd6af750dcd958ac9},
+	{0xaaf29d916709fed8, 0x90f18c6ab3c1c1de},
+	{0xe84ee2de03aba67d, 0x030b9c2ed9074b7d},
+	{0x86235f2773f9ada1, 0x7c84d4e995efc9c1},
+	{0x98b398aab1eaf846, 0x4916d210db82df6e},
+}
+
+// TestSum64KnownAnswers checks both t1ha1 backends, which -impl t1ha1
+// switches between, against the reference digests.
+func TestSum64KnownAnswers(t *testing.T) {
+	for i, in := range testInputs {
+		for j, seed := range []uint64{0, 42} {
+			want := t1ha1Answers[i][j]
+			if got := Sum64([]byte(in), seed); got != want {
+				t.Errorf("%s backend, %d bytes, seed %d: got %#016x, want %#016x", Backend, len(in), seed, got, want)
+			}
+			if got := Sum64Go([]byte(in), seed); got != want {
+				t.Errorf("go, %d bytes, seed %d: got %#016x, want %#016x", len(in), seed, got, want)
+			}
+		}
+	}
+}
@@ -13,13 +13,29 @@ package wyhashc
 static inline uint64_t wyhash_go(const void* data, size_t len) {
     return wyhash(data, len, 0, _wyp);
 }
+
+static inline uint64_t wyhash_seed_go(const void* data, size_t len, uint64_t seed) {
+    return wyhash(data, len, seed, _wyp);
+}
 */
 import "C"
 import "unsafe"
 
+// Backend names the implementation compiled into this build.
+const Backend = "c"
+
 func Sum64(b []byte) uint64 {
 	if len(b) == 0 {
 		return 0
 	}
 	return uint64(C.wyhash_go(unsafe.Pointer(&b[0]), C.size_t(len(b))))
 }
+
+// Sum64Seed hashes b with the given seed.
+func Sum64Seed(b []byte, seed uint64) uint64 {
+	var ptr unsafe.Pointer
+	if len(b) > 0 {
+		ptr = unsafe.Pointer(&b[0])
+	}
+	return uint64(C.wyhash_seed_go(ptr, C.size_t(len(b)), C.uint64_t(seed)))
+}
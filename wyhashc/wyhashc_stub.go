@@ -4,6 +4,14 @@ package wyhashc
 
 import "github.com/zeebo/wyhash"
 
+// Backend names the implementation compiled into this build.
+const Backend = "go"
+
 func Sum64(b []byte) uint64 {
 	return wyhash.Hash(b, 0)
 }
+
+// Sum64Seed hashes b with the given seed.
+func Sum64Seed(b []byte, seed uint64) uint64 {
+	return wyhash.Hash(b, seed)
+}
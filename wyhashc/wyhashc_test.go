@@ -0,0 +1,39 @@
+//go:build cgo && (amd64 || arm64)
+
+package wyhashc
+
+import "testing"
+
+// knownAnswers are the bundled C wyhash digests without a seed and with seed
+// 42. The pure Go fallback used in builds without cgo implements a
+// different revision and is not expected to match.
+var knownAnswers = []struct {
+	in   string
+	want [2]uint64
+}{
+	{"", [2]uint64{0x0000000000000000, 0x2ac44db3deb05300}},
+	{"a", [2]uint64{0xaced12527fe5bff8, 0x30dbb7b7a902ea66}},
+	{"abc", [2]uint64{0x989b4a209c1011c9, 0xb0632d5ba93fcab5}},
+	{"message digest", [2]uint64{0x309ab4c045215e8f, 0x01e6eb307c28d441}},
+	{"The quick brown fox jumps over the lazy dog", [2]uint64{0x08e445df107bb587, 0x4de361bb10d3d7fc}},
+	{counting(1000), [2]uint64{0xb0aaefd54a691522, 0x446d60678e1b67cd}},
+}
+
+func counting(n int) string {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i)
+	}
+	return string(b)
+}
+
+func TestKnownAnswers(t *testing.T) {
+	for _, tc := range knownAnswers {
+		if got := Sum64([]byte(tc.in)); got != tc.want[0] {
+			t.Errorf("%d bytes: got %#016x, want %#016x", len(tc.in), got, tc.want[0])
+		}
+		if got := Sum64Seed([]byte(tc.in), 42); got != tc.want[1] {
+			t.Errorf("%d bytes, seed 42: got %#016x, want %#016x", len(tc.in), got, tc.want[1])
+		}
+	}
+}
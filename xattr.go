@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// xattrMode keeps checksums in extended attributes of the files themselves
+// instead of in a list.
+var xattrMode bool
+
+// xattrPrefix namespaces the attributes. Each file gets
+// user.checksum.digest, .algo, .backend, .size and .mtime, the last two
+// describing the file when it was hashed.
+const xattrPrefix = "user.checksum."
+
+var errNoXattr = errors.New("no checksum attributes")
+
+// xattrRecord is the checksum stored on a file.
+type xattrRecord struct {
+	Digest  string
+	Algo    string
+	Backend string // empty on files hashed before it was recorded
+	Size    int64
+	MTime   int64 // Unix nanoseconds
+}
+
+// current reports whether the file fi describes is still the one r was
+// made for.
+func (r xattrRecord) current(fi os.FileInfo) bool {
+	return r.Size == fi.Size() && r.MTime == fi.ModTime().UnixNano()
+}
+
+// readXattrs returns the checksum attributes of path, or errNoXattr if it
+// has none.
+func readXattrs(path string) (xattrRecord, error) {
+	var r xattrRecord
+	get := func(name string) (string, error) {
+		v, err := getXattr(path, xattrPrefix+name)
+		if err != nil && err != errNoXattr {
+			return "", &fs.PathError{Op: "getxattr", Path: path, Err: err}
+		}
+		return v, err
+	}
+	var err error
+	if r.Digest, err = get("digest"); err != nil {
+		return r, err
+	}
+	var size, mtime string
+	if r.Algo, err = get("algo"); err == nil {
+		if size, err = get("size"); err == nil {
+			mtime, err = get("mtime")
+		}
+	}
+	if err == nil {
+		if r.Backend, err = get("backend"); err == errNoXattr {
+			err = nil
+		}
+	}
+	if err == errNoXattr {
+		return r, &fs.PathError{Op: "getxattr", Path: path, Err: errors.New("incomplete checksum attributes")}
+	}
+	if err != nil {
+		return r, err
+	}
+	r.Size, err = strconv.ParseInt(size, 10, 64)
+	if err == nil {
+		r.MTime, err = strconv.ParseInt(mtime, 10, 64)
+	}
+	if err != nil {
+		return r, &fs.PathError{Op: "getxattr", Path: path, Err: err}
+	}
+	return r, nil
+}
+
+// writeXattrs stores r on path. An earlier digest is removed first and the
+// new one goes last, so that a file is only seen as hashed once every
+// attribute is in place: a run interrupted in between leaves a file without
+// a digest rather than an old digest next to the new size and mtime.
+func writeXattrs(path string, r xattrRecord) error {
+	if err := removeXattr(path, xattrPrefix+"digest"); err != nil {
+		return &fs.PathError{Op: "removexattr", Path: path, Err: err}
+	}
+	attrs := [][2]string{
+		{"algo", r.Algo},
+		{"backend", r.Backend},
+		{"size", strconv.FormatInt(r.Size, 10)},
+		{"mtime", strconv.FormatInt(r.MTime, 10)},
+		{"digest", r.Digest},
+	}
+	for _, a := range attrs {
+		if err := setXattr(path, xattrPrefix+a[0], a[1]); err != nil {
+			return &fs.PathError{Op: "setxattr", Path: path, Err: err}
+		}
+	}
+	return nil
+}
+
+// walkRegular returns the regular files under dir with their details.
+func walkRegular(ctx context.Context, dir string) ([]string, map[string]os.FileInfo, error) {
+	var paths []string
+	infos := map[string]os.FileInfo{}
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return errInterrupted
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		paths = append(paths, path)
+		infos[path] = fi
+		return nil
+	})
+	return paths, infos, err
+}
+
+// generateXattrs hashes the regular files under dir and stores the result
+// in their attributes. Files that already carry attributes are skipped;
+// with update, those whose size or mtime has moved since are hashed again.
+func generateXattrs(ctx context.Context, dir string, update, progress bool, algo string, rep reporter) error {
+	all, infos, err := walkRegular(ctx, dir)
+	if err != nil {
+		return err
+	}
+	var paths []string
+	var current, stale int
+	for _, p := range all {
+		r, err := readXattrs(p)
+		switch {
+		case err == errNoXattr:
+			paths = append(paths, p)
+		case err != nil:
+			// Unreadable or partly written attributes are replaced.
+			paths = append(paths, p)
+		case update && checkDigestBackend("", r.Algo, r.Backend) != nil:
+			// Digests another build made that this one cannot verify.
+			paths = append(paths, p)
+		case r.current(infos[p]):
+			current++
+		case update:
+			paths = append(paths, p)
+		default:
+			stale++
+			fmt.Printf("%s STALE\n", p)
+		}
+	}
+
+	report := newGenerateReport(rep)
+	sums, err := hashAll(ctx, paths, report.wrap(func(p string, read *atomic.Int64) (string, error) {
+		fi := infos[p]
+		sum, err := hashWithRetry(ctx, p, algo, read)
+		if err != nil {
+			return "", err
+		}
+		// hashFile only guarantees the file held still while it was read;
+		// the attributes must describe the file as it was walked.
+		if now, err := os.Stat(p); err != nil || !unchanged(fi, now) {
+			return "", &fs.PathError{Op: "read", Path: p, Err: errUnstable}
+		}
+		r := xattrRecord{Digest: sum, Algo: algo, Backend: backendOf(algo), Size: fi.Size(), MTime: fi.ModTime().UnixNano()}
+		return sum, writeXattrs(p, r)
+	}), progress)
+	if err != nil {
+		return err
+	}
+	if err := report.close(len(paths)); err != nil {
+		return err
+	}
+	fmt.Printf("Hashed:%d Current:%d Stale:%d Failed:%d\n", len(sums), current, stale, len(paths)-len(sums))
+	if stale > 0 {
+		fmt.Fprintln(os.Stderr, "Files changed since their attributes were written; rerun with -update to hash them again")
+	}
+	if len(sums) < len(paths) {
+		return fmt.Errorf("%d files could not be hashed", len(paths)-len(sums))
+	}
+	return nil
+}
+
+// verifyXattrs checks the regular files under dir against their checksum
+// attributes, each with the algorithm recorded on it. Files without
+// attributes are NOT_IN_LIST; files whose size or mtime moved since they
+// were hashed are reported as STALE and not read.
+func verifyXattrs(ctx context.Context, dir string, show statusSet, progress bool, rep reporter) error {
+	col := newVerifyCollector(show, rep)
+	col.stale = true
+	all, infos, err := walkRegular(ctx, dir)
+	if err != nil {
+		return err
+	}
+
+	records := map[string]xattrRecord{}
+	var paths []string
+	var stale, broken int
+	for _, p := range all {
+		r, err := readXattrs(p)
+		if err == nil {
+			// A digest this build cannot reproduce would only come out
+			// CORRUPTED.
+			if berr := checkDigestBackend("attributes were written", r.Algo, r.Backend); berr != nil {
+				err = &fs.PathError{Op: "verify", Path: p, Err: berr}
+			}
+		}
+		switch {
+		case err == errNoXattr:
+			col.add(fileResult{path: p, status: statusNotInList, size: infos[p].Size()})
+		case err != nil:
+			broken++
+			col.add(fileResult{path: p, status: statusUnreadable, size: infos[p].Size(), err: err})
+		case !r.current(infos[p]):
+			stale++
+			col.add(fileResult{path: p, status: statusStale, size: infos[p].Size()})
+		default:
+			records[p] = r
+			paths = append(paths, p)
+		}
+	}
+
+	var mu sync.Mutex
+	failures := map[string]error{}
+	sums, err := hashAll(ctx, paths, func(p string, read *atomic.Int64) (string, error) {
+		sum, err := hashWithRetry(ctx, p, records[p].Algo, read)
+		if err != nil {
+			mu.Lock()
+			failures[p] = err
+			mu.Unlock()
+		}
+		return sum, err
+	}, progress)
+	if err != nil {
+		return err
+	}
+	slices.Sort(paths)
+	for _, p := range paths {
+		r := fileResult{path: p, expected: records[p].Digest, actual: sums[p], size: infos[p].Size(), err: failures[p]}
+		r.status = statusOf(r.err, r.expected, r.actual)
+		if fi, err := os.Stat(p); err == nil && r.status == statusMismatch {
+			r.status = classifyMismatch(records[p].Size, records[p].MTime, fi)
+		}
+		col.add(r)
+	}
+
+	total := len(paths) + stale + broken
+	col.summarize(total, "All files match")
+	return col.close(total)
+}
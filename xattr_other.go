@@ -0,0 +1,19 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+var errXattrUnsupported = errors.New("extended attributes are only supported on Linux")
+
+func getXattr(path, name string) (string, error) {
+	return "", errXattrUnsupported
+}
+
+func setXattr(path, name, value string) error {
+	return errXattrUnsupported
+}
+
+func removeXattr(path, name string) error {
+	return errXattrUnsupported
+}